@@ -0,0 +1,164 @@
+package testscript
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/tools/txtar"
+)
+
+// endMarker is the name of the marker line that closes an inline file
+// section, so that script commands can follow it.
+const endMarker = "end"
+
+// A scriptFile is a parsed .tsar file.
+//
+// A .tsar file is a txtar archive whose comment section holds the script.
+// In addition, file sections may be interleaved with script commands: a
+// run of sections closed by a "-- end --" line is inline, and is written
+// relative to the current directory when execution reaches it. Sections
+// that are not closed form the trailing archive, which runs to the end of
+// the file and is extracted into $WORK before the script starts, as in
+// plain txtar.
+type scriptFile struct {
+	steps   []scriptStep // script lines and inline file sections, in order
+	archive []scriptStep // trailing file sections
+}
+
+// A scriptStep is either a single script line or a file section.
+type scriptStep struct {
+	lineno int         // line number in the .tsar file
+	line   string      // script line, if file is nil
+	file   *txtar.File // file section
+	index  int         // for a file section, its index in txtar.Parse's Files
+}
+
+// parseScript parses the contents of a .tsar file.
+func parseScript(data []byte) (*scriptFile, error) {
+	sf := new(scriptFile)
+	var (
+		pending []scriptStep // sections not yet known to be inline
+		cur     *txtar.File  // section being read
+		curLine int          // line number of cur's marker
+		curIdx  int          // index of cur among all markers, including end markers
+		markers int          // number of markers so far
+	)
+	flush := func() {
+		if cur != nil {
+			fixNL(&cur.Data)
+			pending = append(pending, scriptStep{lineno: curLine, file: cur, index: curIdx})
+			cur = nil
+		}
+	}
+	for lineno := 1; len(data) > 0; lineno++ {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i+1], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
+		name, isMarker := sectionMarker(line)
+		if isMarker {
+			markers++
+		}
+		switch {
+		case isMarker && name == endMarker:
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: -- %s -- without a preceding file section", lineno, endMarker)
+			}
+			flush()
+			sf.steps = append(sf.steps, pending...)
+			pending = nil
+		case isMarker:
+			flush()
+			cur = &txtar.File{Name: name}
+			curLine = lineno
+			curIdx = markers - 1
+		case cur != nil:
+			cur.Data = append(cur.Data, line...)
+		default:
+			sf.steps = append(sf.steps, scriptStep{
+				lineno: lineno,
+				line:   strings.TrimRight(string(line), "\r\n"),
+			})
+		}
+	}
+	flush()
+	sf.archive = pending
+	return sf, nil
+}
+
+// strayCommand looks in the trailing archive of sf for a line that looks
+// like a script command: a line whose first word, after any '!' or '?'
+// prefix and conditions, names a command for which isCommand returns
+// true. Such a line may belong to a script whose author forgot to close a
+// section with "-- end --", so that it would silently never run.
+// strayCommand returns the line's number and its text, or 0.
+func (sf *scriptFile) strayCommand(isCommand func(name string) bool) (int, string) {
+	for _, step := range sf.archive {
+		for i, line := range strings.SplitAfter(string(step.file.Data), "\n") {
+			if line = strings.TrimSpace(line); looksLikeCommand(line, isCommand) {
+				return step.lineno + 1 + i, line
+			}
+		}
+	}
+	return 0, ""
+}
+
+// looksLikeCommand reports whether line reads as a script command; see
+// strayCommand.
+func looksLikeCommand(line string, isCommand func(name string) bool) bool {
+	_, rest, err := parseConds(line)
+	if err != nil {
+		return false
+	}
+	words := strings.Fields(rest)
+	if len(words) > 0 && (words[0] == "!" || words[0] == "?") {
+		words = words[1:]
+	}
+	return len(words) > 0 && isCommand(words[0])
+}
+
+// sectionMarker reports whether line is a txtar file marker
+// ("-- name --") and returns the name it holds.
+func sectionMarker(line []byte) (name string, ok bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if !bytes.HasPrefix(line, []byte("-- ")) || !bytes.HasSuffix(line, []byte(" --")) || len(line) < 6 {
+		return "", false
+	}
+	name = strings.TrimSpace(string(line[3 : len(line)-3]))
+	return name, name != ""
+}
+
+// fixNL makes sure non-empty file data ends in a newline, as txtar does.
+func fixNL(data *[]byte) {
+	if d := *data; len(d) > 0 && d[len(d)-1] != '\n' {
+		*data = append(d, '\n')
+	}
+}
+
+// scriptTags returns the tags declared in the header of a script: the
+// comment and blank lines that open it. Tags are listed on lines of the
+// form "# tags: a b", separated by spaces or commas.
+func scriptTags(data []byte) []string {
+	var tags []string
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte("\n"))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		comment, ok := bytes.CutPrefix(line, []byte("#"))
+		if !ok {
+			break
+		}
+		if list, ok := bytes.CutPrefix(bytes.TrimSpace(comment), []byte("tags:")); ok {
+			tags = append(tags, strings.FieldsFunc(string(list), func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})...)
+		}
+	}
+	return tags
+}
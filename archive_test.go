@@ -0,0 +1,106 @@
+package testscript
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/txtar"
+)
+
+func TestParseScript(t *testing.T) {
+	data := []byte(`# comment
+mkdir sub
+-- a.txt --
+a
+-- b.txt --
+b
+-- end --
+exists a.txt
+-- c.txt --
+c
+-- d.txt --
+d`)
+	sf, err := parseScript(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	for _, step := range sf.steps {
+		if step.file != nil {
+			steps = append(steps, fmt.Sprintf("%d: file %s: %s", step.lineno, step.file.Name, step.file.Data))
+		} else {
+			steps = append(steps, fmt.Sprintf("%d: %s", step.lineno, step.line))
+		}
+	}
+	want := []string{
+		"1: # comment",
+		"2: mkdir sub",
+		"3: file a.txt: a\n",
+		"5: file b.txt: b\n",
+		"8: exists a.txt",
+	}
+	if got := strings.Join(steps, "|"); got != strings.Join(want, "|") {
+		t.Errorf("steps:\n%q\nwant:\n%q", steps, want)
+	}
+	if len(sf.archive) != 2 || sf.archive[0].file.Name != "c.txt" || string(sf.archive[1].file.Data) != "d\n" {
+		t.Errorf("unexpected trailing archive %+v", sf.archive)
+	}
+
+	// Section indexes refer to the sections as txtar sees them.
+	ar := txtar.Parse(data)
+	for _, step := range append(sf.steps, sf.archive...) {
+		if step.file != nil && ar.Files[step.index].Name != step.file.Name {
+			t.Errorf("section %s has index %d, which txtar names %s", step.file.Name, step.index, ar.Files[step.index].Name)
+		}
+	}
+}
+
+func TestParseScriptStrayEnd(t *testing.T) {
+	_, err := parseScript([]byte("exists a\n-- end --\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2: -- end -- without a preceding file section") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestScriptTags(t *testing.T) {
+	got := scriptTags([]byte(`# A script.
+# tags: slow network
+#tags:linux,docker
+
+# tags: late
+exists foo
+# tags: ignored
+`))
+	want := []string{"slow", "network", "linux", "docker", "late"}
+	if !slices.Equal(got, want) {
+		t.Errorf("scriptTags = %q, want %q", got, want)
+	}
+}
+
+func TestStrayCommand(t *testing.T) {
+	isCommand := func(name string) bool { return name == "exists" || name == "exec" }
+	tests := []struct {
+		script string
+		lineno int
+	}{
+		{"exists a\n-- a --\ndata\n\nexists a\n", 5},
+		{"-- a --\ndata\n# check\n! exists b\n", 4},
+		{"-- a --\ndata\n\n[linux] ? exec tool\n", 4},
+		{"-- a.txt --\nhello\nexists a.txt\n", 3},
+		{"-- a --\nexists a\n", 2},
+		{"-- a --\ndata\n\nexist a\n", 0},
+		{"-- a --\n\n[section]\n", 0},
+		{"-- a --\ndata\n-- end --\n\nexists a\n", 0},
+	}
+	for _, tt := range tests {
+		sf, err := parseScript([]byte(tt.script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lineno, _ := sf.strayCommand(isCommand); lineno != tt.lineno {
+			t.Errorf("strayCommand(%q) = %d, want %d", tt.script, lineno, tt.lineno)
+		}
+	}
+}
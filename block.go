@@ -0,0 +1,120 @@
+package testscript
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scripts group steps into if blocks, which nest:
+//
+//	if [windows]
+//	exec cmd /c echo hello
+//	else
+//	exec echo hello
+//	end
+//
+// The steps between if and else, or end, run only if all the conditions
+// of the if line hold, and the steps between else and end only if they
+// don't. Inline file sections in a block that doesn't run are not written.
+
+// blockKeyword returns the block keyword (if, else or end) that starts
+// line, if any, and the rest of the line.
+func blockKeyword(line string) (kw, rest string) {
+	line = strings.TrimSpace(line)
+	for _, kw := range []string{"if", "else", "end"} {
+		rest, ok := strings.CutPrefix(line, kw)
+		if ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t') {
+			return kw, strings.TrimSpace(rest)
+		}
+	}
+	return "", ""
+}
+
+// checkBlocks checks that the if blocks of a script are well formed, so
+// that a mistake is reported before any step runs. It returns the line
+// number of the first mistake along with it.
+func checkBlocks(steps []scriptStep) (int, error) {
+	type openBlock struct {
+		lineno  int  // line of the if
+		hasElse bool // whether the else has been seen
+	}
+	var open []openBlock // enclosing blocks, innermost last
+	for _, step := range steps {
+		if step.file != nil {
+			continue
+		}
+		conds, line, err := parseConds(strings.TrimSpace(step.line))
+		if err != nil {
+			// parseLine reports it if the line runs.
+			continue
+		}
+		kw, rest := blockKeyword(line)
+		switch {
+		case kw == "":
+			continue
+		case len(conds) > 0:
+			return step.lineno, fmt.Errorf("%s cannot follow a condition", kw)
+		}
+		switch kw {
+		case "if":
+			conds, rest, err := parseConds(rest)
+			switch {
+			case err != nil:
+				return step.lineno, err
+			case len(conds) == 0:
+				return step.lineno, fmt.Errorf("if requires a condition, as in if [linux]")
+			case rest != "":
+				return step.lineno, fmt.Errorf("unexpected %q after if conditions", rest)
+			}
+			open = append(open, openBlock{lineno: step.lineno})
+		case "else":
+			switch {
+			case rest != "":
+				return step.lineno, fmt.Errorf("else takes no arguments")
+			case len(open) == 0:
+				return step.lineno, fmt.Errorf("else without if")
+			case open[len(open)-1].hasElse:
+				return step.lineno, fmt.Errorf("second else for if at line %d", open[len(open)-1].lineno)
+			}
+			open[len(open)-1].hasElse = true
+		case "end":
+			switch {
+			case rest != "":
+				return step.lineno, fmt.Errorf("end takes no arguments")
+			case len(open) == 0:
+				return step.lineno, fmt.Errorf("end without if")
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) > 0 {
+		return open[len(open)-1].lineno, fmt.Errorf("if without end")
+	}
+	return 0, nil
+}
+
+// block runs a block keyword line, given whether the branch of each
+// enclosing block runs, innermost last, and returns the updated list.
+// The script must have passed checkBlocks.
+func (ts *TestScript) block(runs []bool, kw, rest string) []bool {
+	active := len(runs) == 0 || runs[len(runs)-1]
+	switch kw {
+	case "if":
+		if !active {
+			// Don't evaluate the conditions of a block that can't run.
+			return append(runs, false)
+		}
+		conds, _, _ := parseConds(rest)
+		ok, err := ts.evalConds(conds)
+		if err != nil {
+			ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+		}
+		return append(runs, ok)
+	case "else":
+		outer := len(runs) == 1 || runs[len(runs)-2]
+		runs[len(runs)-1] = outer && !active
+	case "end":
+		runs = runs[:len(runs)-1]
+	}
+	return runs
+}
@@ -0,0 +1,51 @@
+package testscript
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBlockErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"Unterminated", "if [linux]\nexists a\nif [darwin]\nend\n", "script:1: if without end"},
+		{"UnterminatedInner", "if [linux]\nif [darwin]\nend\n", "script:1: if without end"},
+		{"ElseWithoutIf", "exists a\nelse\n", "script:2: else without if"},
+		{"EndWithoutIf", "if [linux]\nend\nend\n", "script:3: end without if"},
+		{"SecondElse", "if [linux]\nelse\nelse\nend\n", "script:3: second else for if at line 1"},
+		{"NoCondition", "if\nend\n", "script:1: if requires a condition, as in if [linux]"},
+		{"Command", "if [linux] exists a\nend\n", `script:1: unexpected "exists a" after if conditions`},
+		{"BadCondition", "if [linux ||]\nend\n", "script:1: bad condition [linux ||]: missing condition at end"},
+		{"Guarded", "if [linux]\n[short] end\n", "script:2: end cannot follow a condition"},
+		{"ElseArgs", "if [linux]\nelse [darwin]\nend\n", "script:2: else takes no arguments"},
+		{"UnknownCondition", "exists a\nif [nope]\nend\n-- a --\n", `script:2: unknown condition "nope"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := runScript(t, Params{}, tt.script)
+			if !rt.failed {
+				t.Fatalf("script succeeded unexpectedly")
+			}
+			if !strings.HasPrefix(rt.fatal, tt.want) {
+				t.Errorf("failure %q, want %q", rt.fatal, tt.want)
+			}
+		})
+	}
+
+	// Mistakes are reported before any step runs.
+	ran := false
+	rt := runScript(t, Params{
+		Commands: map[string]func(*TestScript, bool, []string){
+			"record": func(*TestScript, bool, []string) { ran = true },
+		},
+	}, "record\nend\n")
+	if rt.fatal != "script:2: end without if" {
+		t.Errorf("failure %q", rt.fatal)
+	}
+	if ran {
+		t.Errorf("steps ran before the error")
+	}
+}
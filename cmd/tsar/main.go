@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gfanton/testscript"
 	"github.com/peterbourgon/ff/v4"
@@ -18,9 +24,23 @@ type config struct {
 	short               bool
 	testWork            bool
 	workdirRoot         string
+	stableWorkdir       bool
 	contineOnError      bool
 	requireExplicitExec bool
 	requireUniqueNames  bool
+	jobs                int
+	timeout             time.Duration
+	scriptTimeout       time.Duration
+	runPattern          string
+	skipPattern         string
+	tags                string
+	format              string
+	reportFile          string
+	update              bool
+	coverDir            string
+	passEnv             string
+	strictEnv           bool
+	strictArchive       bool
 }
 
 func (cfg *config) registerFlags(fs *ff.FlagSet) {
@@ -28,9 +48,23 @@ func (cfg *config) registerFlags(fs *ff.FlagSet) {
 	fs.BoolVar(&cfg.short, 's', "short", "run tests in short mode")
 	fs.BoolVar(&cfg.testWork, 0, "test-work", "preserve work directories after tests")
 	fs.StringVar(&cfg.workdirRoot, 'w', "workdir-root", "", "root directory for work directories")
+	fs.BoolVar(&cfg.stableWorkdir, 0, "stable-workdir", "name work directories after their script (workdir-root/NAME); requires -w")
 	fs.BoolVar(&cfg.contineOnError, 'c', "continue-on-error", "continue executing tests after an error")
 	fs.BoolVar(&cfg.requireExplicitExec, 'e', "require-explicit-exec", "require explicit 'exec' for command execution")
 	fs.BoolVar(&cfg.requireUniqueNames, 'u', "require-unique-names", "require unique test names")
+	fs.IntVar(&cfg.jobs, 'j', "jobs", 1, "number of scripts to run in parallel")
+	fs.DurationVar(&cfg.timeout, 't', "timeout", 0, "fail scripts still running after this long in total (0 means no limit)")
+	fs.DurationVar(&cfg.scriptTimeout, 0, "script-timeout", 0, "fail any script running longer than this (0 means no limit)")
+	fs.StringVar(&cfg.runPattern, 0, "run", "", "run only scripts whose name matches this regular expression")
+	fs.StringVar(&cfg.skipPattern, 0, "skip", "", "do not run scripts whose name matches this regular expression")
+	fs.StringVar(&cfg.tags, 0, "tags", "", "run only scripts with one of these comma-separated tags; prefix a tag with ! to exclude it")
+	fs.BoolVar(&cfg.update, 0, "update", "rewrite file sections compared by a failing 'cmp stdout' or 'cmp stderr' with the actual output")
+	fs.StringVar(&cfg.passEnv, 0, "pass-env", "", "comma-separated host environment variables to pass to scripts")
+	fs.BoolVar(&cfg.strictEnv, 0, "strict-env", "fail scripts that expand an unset environment variable")
+	fs.BoolVar(&cfg.strictArchive, 0, "strict-archive", "fail scripts whose trailing archive holds lines that look like commands")
+	fs.StringVar(&cfg.coverDir, 0, "coverdir", "", "collect coverage data of programs built with -cover in DIR/<script name>")
+	fs.StringVar(&cfg.format, 'f', "format", "text", "output format: text, json (as go test -json), junit or tap")
+	fs.StringVar(&cfg.reportFile, 0, "report-file", "", "write the report in --format to this file, and text output to stdout")
 }
 
 func main() {
@@ -41,7 +75,7 @@ func main() {
 
 	tsCmd := &ff.Command{
 		Name:  "tsar",
-		Usage: "tsar [FLAGS] SUBCOMMAND ...",
+		Usage: "tsar [FLAGS] FILE|DIR|DIR/... ...",
 		Flags: fs,
 		Exec: func(ctx context.Context, args []string) error {
 			return execTestRunner(ctx, &cfg, args)
@@ -59,29 +93,22 @@ func main() {
 }
 
 func execTestRunner(ctx context.Context, cfg *config, args []string) error {
-	// Initialize testing framework properly
-	// We need to call flag.Parse() with empty args to initialize testing flags
-	os.Args = []string{os.Args[0]} // Keep only program name
-
 	// Use the manually separated non-flag arguments
 	if len(args) == 0 {
 		return fmt.Errorf("not enough argument")
 	}
 
-	target := args[0]
-
-	// Determine if target is a file or directory
-	info, err := os.Stat(target)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: cannot access %s: %v\n", target, err)
-		os.Exit(1)
+	if cfg.stableWorkdir && cfg.workdirRoot == "" {
+		return fmt.Errorf("--stable-workdir requires --workdir-root")
 	}
 
-	oldArgs := os.Args
-	os.Args = []string{"tsar"}
-	flag.Parse()
+	// Built-in conditions such as [short] consult the testing package's
+	// flags, so register and parse them (without any arguments) first.
 	testing.Init()
-	
+	if err := flag.CommandLine.Parse(nil); err != nil {
+		return err
+	}
+
 	// Set up test flags after testing.Init()
 	if cfg.short {
 		flag.Set("test.short", "true")
@@ -90,51 +117,186 @@ func execTestRunner(ctx context.Context, cfg *config, args []string) error {
 	if cfg.verbose {
 		flag.Set("test.v", "true")
 	}
-	os.Args = oldArgs
 
 	// Create parameters for testscript
 	params := testscript.Params{
 		TestWork:            cfg.testWork,
 		WorkdirRoot:         cfg.workdirRoot,
+		StableWorkdir:       cfg.stableWorkdir,
 		ContinueOnError:     cfg.contineOnError,
 		RequireExplicitExec: cfg.requireExplicitExec,
 		RequireUniqueNames:  cfg.requireUniqueNames,
+		ScriptTimeout:       cfg.scriptTimeout,
+		RunPattern:          cfg.runPattern,
+		SkipPattern:         cfg.skipPattern,
+		UpdateScripts:       cfg.update,
+		StrictEnv:           cfg.strictEnv,
+		StrictArchive:       cfg.strictArchive,
+	}
+	if cfg.coverDir != "" {
+		// Scripts run from other directories, so make the path absolute.
+		dir, err := filepath.Abs(cfg.coverDir)
+		if err != nil {
+			return err
+		}
+		params.CoverDir = dir
+	}
+	params.Tags = splitList(cfg.tags)
+	params.PassEnv = splitList(cfg.passEnv)
+	if cfg.timeout > 0 {
+		params.Deadline = time.Now().Add(cfg.timeout)
 	}
 
-	// Create a testResultCapture to capture test results
-	runner := &testResultCapture{
-		verbose: cfg.verbose,
+	sets, err := parseTargets(args, params)
+	if err != nil {
+		return err
+	}
+
+	rep, closeReport, err := cfg.newReporter(os.Stdout)
+	if err != nil {
+		return err
+	}
+	ok, err := runScripts(rep, cfg.jobs, sets)
+	if cerr := closeReport(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing report: %v", err)
+	}
+	if !ok {
+		return fmt.Errorf("tests failed")
 	}
 
-	if !info.IsDir() {
-		// Single file execution
-		if !strings.HasSuffix(target, ".tsar") {
-			return fmt.Errorf("file must have .tsar extension: %s", target)
+	return nil
+}
+
+// newReporter returns the reporter for cfg's --format and --report-file,
+// and a function closing the report file.
+func (cfg *config) newReporter(stdout io.Writer) (reporter, func() error, error) {
+	if cfg.reportFile == "" {
+		rep, err := newReporter(cfg.format, stdout, cfg.verbose)
+		return rep, func() error { return nil }, err
+	}
+	f, err := os.Create(cfg.reportFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	rep, err := newReporter(cfg.format, f, cfg.verbose)
+	if err != nil {
+		f.Close()
+		os.Remove(cfg.reportFile)
+		return nil, nil, err
+	}
+	text := &textReporter{w: stdout, verbose: cfg.verbose}
+	return multiReporter{text, rep}, f.Close, nil
+}
+
+// splitList splits a comma-separated flag value into its non-empty
+// elements.
+func splitList(s string) []string {
+	var list []string
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			list = append(list, elem)
 		}
+	}
+	return list
+}
 
-		absPath, err := filepath.Abs(target)
-		if err != nil {
-			return fmt.Errorf("cannot get absolute path for %s: %v", target, err)
+// A scriptSet is a group of scripts named on the command line.
+type scriptSet struct {
+	params testscript.Params
+	files  []string // script files; if nil, the scripts found in params.Dir
+}
+
+// parseTargets turns the command-line arguments into sets of scripts.
+// Each argument is a .tsar file, a directory whose .tsar files are run,
+// or a directory followed by "/..." (such as ./...) whose scripts are
+// looked for recursively and named after their path within it. All the
+// files named directly form a single set.
+func parseTargets(args []string, params testscript.Params) ([]scriptSet, error) {
+	var sets []scriptSet
+	files := -1 // index in sets of the set of files named directly
+	for _, target := range args {
+		dir, recursive := strings.CutSuffix(target, "...")
+		if recursive {
+			if dir != "" && !os.IsPathSeparator(dir[len(dir)-1]) {
+				return nil, fmt.Errorf("invalid pattern %s: ... must follow a path separator", target)
+			}
+			if dir == "" {
+				dir = "."
+			}
+			target = dir
 		}
 
-		params.Dir = filepath.Dir(absPath)
-		testscript.RunFilesStandalone(runner, params, absPath)
-	} else {
-		// Directory execution
+		// Determine if target is a file or directory
+		info, err := os.Stat(target)
+		if err != nil {
+			return nil, fmt.Errorf("cannot access %s: %v", target, err)
+		}
 		absPath, err := filepath.Abs(target)
 		if err != nil {
-			return fmt.Errorf("cannot get absolute path for %s: %v", target, err)
+			return nil, fmt.Errorf("cannot get absolute path for %s: %v", target, err)
 		}
 
-		params.Dir = absPath
-		testscript.RunStandalone(runner, params)
-	}
+		if !info.IsDir() {
+			// Single file execution
+			if recursive {
+				return nil, fmt.Errorf("invalid pattern %s...: not a directory", target)
+			}
+			if !strings.HasSuffix(target, ".tsar") {
+				return nil, fmt.Errorf("file must have .tsar extension: %s", target)
+			}
+			if files < 0 {
+				files = len(sets)
+				p := params
+				p.Dir = filepath.Dir(absPath)
+				sets = append(sets, scriptSet{params: p, files: []string{}})
+			}
+			sets[files].files = append(sets[files].files, absPath)
+			continue
+		}
 
-	if runner.failed {
-		return fmt.Errorf("tests failed")
+		// Directory execution
+		p := params
+		p.Dir = absPath
+		p.Recursive = recursive
+		sets = append(sets, scriptSet{params: p})
 	}
+	return sets, nil
+}
 
-	return nil
+// runScripts runs the given sets of scripts, up to jobs scripts at a time,
+// and reports whether they all passed. The output of each script is
+// buffered and passed to rep in one piece once the script completes, so
+// that the output of concurrently running scripts never interleaves.
+// The error is the one rep.done returns.
+func runScripts(rep reporter, jobs int, sets []scriptSet) (bool, error) {
+	jobs = max(jobs, 1)
+	start := time.Now()
+	runner := &testResultCapture{
+		reporter: rep,
+		jobs:     make(chan struct{}, jobs),
+		names:    make(map[string]bool),
+	}
+	runner.root = runner
+	for _, set := range sets {
+		runner.stopOnFailure.Store(!set.params.ContinueOnError)
+		// Scripts of different sets may share a name, and so a stable
+		// work directory, which testscript only checks within a set.
+		runner.uniqueNames = set.params.RequireUniqueNames || set.params.StableWorkdir
+		if runner.stopOnFailure.Load() && runner.Failed() {
+			break
+		}
+		set.params.Parallel = jobs > 1
+		if set.files != nil {
+			testscript.RunFiles(runner, set.params, set.files...)
+		} else {
+			testscript.Run(runner, set.params)
+		}
+	}
+	runner.parallel.Wait()
+	return !runner.Failed(), rep.done(runner.Failed(), time.Since(start))
 }
 
 // run executes the tests
@@ -143,49 +305,165 @@ func (cfg *config) run(target string) error {
 	return nil
 }
 
-// testResultCapture implements TestingT to capture test results
+// testResultCapture implements testscript.SubtestRunner to capture test
+// results. Each script runs as a subtest in its own goroutine, so that
+// Fatal and Skip can stop it as they do for *testing.T; its output is
+// buffered and passed to the root's reporter in one piece when it ends.
 type testResultCapture struct {
-	failed  bool
-	verbose bool
+	name    string
+	root    *testResultCapture
+	failed  atomic.Bool
+	skipped bool
+	dropped bool // not run because an earlier script failed
+	start   time.Time
+
+	// Subtests only.
+	buf        bytes.Buffer  // output, passed to the reporter when done
+	paused     chan struct{} // closed when the subtest calls Parallel
+	isParallel bool
+
+	// Root only.
+	mu            sync.Mutex      // guards calls to reporter, and names
+	reporter      reporter        // destination for results and logs
+	jobs          chan struct{}   // limits the number of running parallel subtests
+	parallel      sync.WaitGroup  // parallel subtests still running
+	stopOnFailure atomic.Bool     // don't start parallel subtests after a failure
+	uniqueNames   bool            // fail subtests named like an earlier one
+	names         map[string]bool // names of the subtests run so far
 }
 
-func (t *testResultCapture) Skip(args ...any) {
-	if t.verbose {
-		fmt.Print("SKIP: ")
-		fmt.Println(args...)
+// Run runs f as a subtest called name and reports whether it succeeded.
+// If the subtest calls Parallel, Run returns as soon as it does.
+func (t *testResultCapture) Run(name string, f func(testscript.TestingT)) bool {
+	t.root.mu.Lock()
+	dup := t.root.names[name]
+	t.root.names[name] = true
+	t.root.mu.Unlock()
+	if dup && t.root.uniqueNames {
+		f = func(t testscript.TestingT) {
+			t.Fatalf("duplicate test name %q", name)
+		}
+	}
+	sub := &testResultCapture{
+		name:   name,
+		root:   t.root,
+		start:  time.Now(),
+		paused: make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer sub.report()
+		f(sub)
+	}()
+	select {
+	case <-done:
+		return !sub.Failed()
+	case <-sub.paused:
+		return true
+	}
+}
+
+// StopOnFailure reports whether a failing script keeps the later ones
+// from running, as it does unless --continue-on-error is set.
+func (t *testResultCapture) StopOnFailure() bool {
+	return t.root.stopOnFailure.Load()
+}
+
+// Parallel signals that the subtest may run alongside others. It waits
+// for one of the root's job slots to become free.
+func (t *testResultCapture) Parallel() {
+	t.isParallel = true
+	t.root.parallel.Add(1)
+	close(t.paused)
+	t.root.jobs <- struct{}{}
+	t.start = time.Now()
+	if t.root.stopOnFailure.Load() && t.root.Failed() {
+		t.dropped = true
+		runtime.Goexit()
+	}
+}
+
+// report passes the result and buffered output of a finished subtest to
+// the root's reporter.
+func (t *testResultCapture) report() {
+	if t.isParallel {
+		defer t.root.parallel.Done()
+		defer func() { <-t.root.jobs }()
+	}
+	if t.dropped {
+		return
 	}
+	r := &scriptResult{
+		name:    t.name,
+		action:  "pass",
+		start:   t.start,
+		elapsed: time.Since(t.start),
+		output:  t.buf.Bytes(),
+	}
+	switch {
+	case t.Failed():
+		t.root.failed.Store(true)
+		r.action = "fail"
+	case t.skipped:
+		r.action = "skip"
+	}
+	t.root.mu.Lock()
+	defer t.root.mu.Unlock()
+	t.root.reporter.result(r)
+}
+
+// log records a line of output. The root's output belongs to no script
+// and goes straight to the reporter.
+func (t *testResultCapture) log(line string) {
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	if t != t.root {
+		t.buf.WriteString(line)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reporter.output(line)
+}
+
+// stop ends the calling subtest, as testing.T.FailNow and SkipNow do.
+// The root is not a subtest, so failures reported to it don't stop it.
+func (t *testResultCapture) stop() {
+	if t != t.root {
+		runtime.Goexit()
+	}
+}
+
+func (t *testResultCapture) Skip(args ...any) {
+	t.skipped = true
+	t.log("SKIP: " + fmt.Sprintln(args...))
+	t.stop()
 }
 
 func (t *testResultCapture) Fatal(args ...any) {
-	t.failed = true
-	fmt.Print("FAIL: ")
-	fmt.Println(args...)
-	// Don't exit here like testing.T does, just mark as failed
+	t.failed.Store(true)
+	t.log("FAIL: " + fmt.Sprintln(args...))
+	t.stop()
 }
 
 func (t *testResultCapture) Fatalf(format string, args ...any) {
-	t.failed = true
-	fmt.Print("FAIL: ")
-	fmt.Printf(format, args...)
-	fmt.Println()
-	// Don't exit here like testing.T does, just mark as failed
+	t.failed.Store(true)
+	t.log("FAIL: " + fmt.Sprintf(format, args...))
+	t.stop()
 }
 
 func (t *testResultCapture) Log(args ...any) {
-	if t.verbose {
-		fmt.Println(args...)
-	}
+	t.log(fmt.Sprintln(args...))
 }
 
 func (t *testResultCapture) Logf(format string, args ...any) {
-	if t.verbose {
-		fmt.Printf(format, args...)
-		fmt.Print("\n")
-	}
+	t.log(fmt.Sprintf(format, args...))
 }
 
 func (t *testResultCapture) Failed() bool {
-	return t.failed
+	return t.failed.Load()
 }
 
 func (t *testResultCapture) Helper() {
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gfanton/testscript"
+)
+
+func TestScripts(t *testing.T) {
+	testscript.Run(t, testscript.Params{
+		Dir: "testdata",
+	})
+}
+
+// runText runs the given scripts, writing verbose text output to w, and
+// reports whether they all passed.
+func runText(w io.Writer, jobs int, sets []scriptSet) bool {
+	ok, _ := runScripts(&textReporter{w: w, verbose: true}, jobs, sets)
+	return ok
+}
+
+func TestRunScriptsParallel(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := range 8 {
+		script := "mkdir a\nexists a\n"
+		if i == 3 {
+			script += "exists missing\n"
+		}
+		file := filepath.Join(dir, fmt.Sprintf("s%d.tsar", i))
+		if err := os.WriteFile(file, []byte(script), 0666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	var out bytes.Buffer
+	ok := runText(&out, 4, []scriptSet{{params: testscript.Params{ContinueOnError: true}, files: files}})
+	if ok {
+		t.Errorf("runScripts succeeded despite a failing script")
+	}
+
+	// Each script's output must appear as one contiguous block.
+	blocks := strings.Split(out.String(), "=== RUN   ")[1:]
+	if len(blocks) != len(files) {
+		t.Fatalf("got %d script outputs, want %d:\n%s", len(blocks), len(files), out.String())
+	}
+	for _, block := range blocks {
+		name, _, _ := strings.Cut(block, "\n")
+		if !strings.Contains(block, "--- PASS: "+name+" (") && !strings.Contains(block, "--- FAIL: "+name+" (") {
+			t.Errorf("output for %s is not contiguous:\n%s", name, block)
+		}
+		if wantFail := name == "s3"; strings.Contains(block, "--- FAIL") != wantFail {
+			t.Errorf("unexpected result for %s:\n%s", name, block)
+		}
+	}
+}
+
+func TestRunScriptsStopOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i, script := range []string{"exists missing\n", "mkdir a\n", "skip\nexists missing\n"} {
+		file := filepath.Join(dir, fmt.Sprintf("s%d.tsar", i))
+		if err := os.WriteFile(file, []byte(script), 0666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	var out bytes.Buffer
+	if runText(&out, 1, []scriptSet{{files: files}}) {
+		t.Errorf("runScripts succeeded despite a failing script")
+	}
+	if strings.Contains(out.String(), "s1") {
+		t.Errorf("script ran after a failure:\n%s", out.String())
+	}
+
+	// Skip stops the script, and each script's failures are its own.
+	out.Reset()
+	if runText(&out, 1, []scriptSet{{params: testscript.Params{ContinueOnError: true}, files: files}}) {
+		t.Errorf("runScripts succeeded despite a failing script")
+	}
+	for _, want := range []string{"--- FAIL: s0 (", "--- PASS: s1 (", "--- SKIP: s2 ("} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestMultipleTargets(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a/one.tsar", "a/sub/two.tsar", "b/three.tsar", "c/four.tsar", "c/five.tsar"} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("exists $WORK\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := []string{
+		filepath.Join(dir, "a") + string(filepath.Separator) + "...",
+		filepath.Join(dir, "b"),
+		filepath.Join(dir, "c", "four.tsar"),
+		filepath.Join(dir, "c", "five.tsar"),
+	}
+	sets, err := parseTargets(args, testscript.Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if !runText(&out, 1, sets) {
+		t.Fatalf("runScripts failed:\n%s", out.String())
+	}
+	var ran []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if name, ok := strings.CutPrefix(line, "=== RUN   "); ok {
+			ran = append(ran, name)
+		}
+	}
+	want := []string{"one", "sub/two", "three", "four", "five"}
+	if strings.Join(ran, " ") != strings.Join(want, " ") {
+		t.Errorf("ran %q, want %q", ran, want)
+	}
+
+	for _, bad := range []string{
+		filepath.Join(dir, "missing"),
+		filepath.Join(dir, "c", "four.tsar") + string(filepath.Separator) + "...",
+		filepath.Join(dir, "a..."),
+	} {
+		if _, err := parseTargets([]string{bad}, testscript.Params{}); err == nil {
+			t.Errorf("parseTargets(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestDuplicateNamesAcrossTargets(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a/foo.tsar", "b/foo.tsar"} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("exists $WORK\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+
+	// Unique work directories don't collide.
+	sets, err := parseTargets(args, testscript.Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if !runText(&out, 4, sets) {
+		t.Fatalf("runScripts failed:\n%s", out.String())
+	}
+
+	// Stable ones would: the second foo must not run.
+	params := testscript.Params{WorkdirRoot: t.TempDir(), StableWorkdir: true, ContinueOnError: true}
+	sets, err = parseTargets(args, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if runText(&out, 4, sets) {
+		t.Fatalf("runScripts succeeded despite duplicate names:\n%s", out.String())
+	}
+	if want := `duplicate test name "foo"`; !strings.Contains(out.String(), want) {
+		t.Errorf("output does not contain %q:\n%s", want, out.String())
+	}
+	if n := strings.Count(out.String(), "--- PASS: foo ("); n != 1 {
+		t.Errorf("foo passed %d times, want 1:\n%s", n, out.String())
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// reportPackage is the package name given to scripts in machine-readable
+// reports, which expect every test to belong to one.
+const reportPackage = "tsar"
+
+// A scriptResult is the outcome of a script that ran.
+type scriptResult struct {
+	name    string
+	action  string // "pass", "fail" or "skip"
+	start   time.Time
+	elapsed time.Duration
+	output  []byte // everything the script logged, one line at a time
+}
+
+// A reporter writes script results in some format. Its methods are never
+// called concurrently.
+type reporter interface {
+	// result reports a script that ran.
+	result(r *scriptResult)
+	// output reports output that belongs to no script.
+	output(text string)
+	// done ends the report once all scripts have finished.
+	done(failed bool, elapsed time.Duration) error
+}
+
+// newReporter returns a reporter writing to w in the given format.
+func newReporter(format string, w io.Writer, verbose bool) (reporter, error) {
+	switch format {
+	case "", "text":
+		return &textReporter{w: w, verbose: verbose}, nil
+	case "json":
+		return &jsonReporter{enc: json.NewEncoder(w)}, nil
+	case "junit":
+		return &junitReporter{w: w}, nil
+	case "tap":
+		return &tapReporter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q (want text, json, junit or tap)", format)
+}
+
+// multiReporter sends results to several reporters.
+type multiReporter []reporter
+
+func (m multiReporter) result(r *scriptResult) {
+	for _, rep := range m {
+		rep.result(r)
+	}
+}
+
+func (m multiReporter) output(text string) {
+	for _, rep := range m {
+		rep.output(text)
+	}
+}
+
+func (m multiReporter) done(failed bool, elapsed time.Duration) error {
+	var firstErr error
+	for _, rep := range m {
+		if err := rep.done(failed, elapsed); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// lines splits output into lines, each ending in a newline.
+func lines(output []byte) []string {
+	var ls []string
+	for len(output) > 0 {
+		var line []byte
+		line, output, _ = bytes.Cut(output, []byte("\n"))
+		ls = append(ls, string(line)+"\n")
+	}
+	return ls
+}
+
+// summary returns the "--- PASS: name (0.00s)" line go test prints for r.
+func summary(r *scriptResult) string {
+	return fmt.Sprintf("--- %s: %s (%.2fs)\n", strings.ToUpper(r.action), r.name, r.elapsed.Seconds())
+}
+
+// firstLine returns the first line of output with the given prefix,
+// without the prefix, or def if there is none.
+func firstLine(output []byte, prefix, def string) string {
+	for _, line := range lines(output) {
+		if msg, ok := strings.CutPrefix(line, prefix); ok {
+			return strings.TrimSpace(msg)
+		}
+	}
+	return def
+}
+
+// textReporter writes results in the style of go test. Unless verbose is
+// set, only the output of failed scripts is shown.
+type textReporter struct {
+	w       io.Writer
+	verbose bool
+}
+
+func (t *textReporter) result(r *scriptResult) {
+	if !t.verbose && r.action != "fail" {
+		return
+	}
+	if t.verbose {
+		fmt.Fprintf(t.w, "=== RUN   %s\n", r.name)
+	}
+	t.w.Write(r.output)
+	io.WriteString(t.w, summary(r))
+}
+
+func (t *textReporter) output(text string) {
+	io.WriteString(t.w, text)
+}
+
+func (t *textReporter) done(failed bool, elapsed time.Duration) error {
+	return nil
+}
+
+// A testEvent is an event in the JSON stream written by go test -json,
+// as documented by cmd/test2json.
+type testEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string  `json:",omitempty"`
+	Elapsed float64 `json:",omitempty"`
+	Output  string  `json:",omitempty"`
+}
+
+// jsonReporter writes results as a stream of test2json events, so that
+// tools reading go test -json can read them too. The events of each script
+// are written together once it ends.
+type jsonReporter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonReporter) emit(e testEvent) {
+	e.Package = reportPackage
+	j.enc.Encode(e)
+}
+
+func (j *jsonReporter) result(r *scriptResult) {
+	end := r.start.Add(r.elapsed)
+	j.emit(testEvent{Time: r.start, Action: "run", Test: r.name})
+	j.emit(testEvent{Time: r.start, Action: "output", Test: r.name, Output: "=== RUN   " + r.name + "\n"})
+	for _, line := range lines(r.output) {
+		j.emit(testEvent{Time: end, Action: "output", Test: r.name, Output: line})
+	}
+	j.emit(testEvent{Time: end, Action: "output", Test: r.name, Output: summary(r)})
+	j.emit(testEvent{Time: end, Action: r.action, Test: r.name, Elapsed: r.elapsed.Seconds()})
+}
+
+func (j *jsonReporter) output(text string) {
+	j.emit(testEvent{Time: time.Now(), Action: "output", Output: text})
+}
+
+func (j *jsonReporter) done(failed bool, elapsed time.Duration) error {
+	action := "pass"
+	if failed {
+		action = "fail"
+	}
+	return j.enc.Encode(testEvent{Time: time.Now(), Action: action, Package: reportPackage, Elapsed: elapsed.Seconds()})
+}
+
+// junitReporter writes results as a JUnit XML document once all scripts
+// have finished.
+type junitReporter struct {
+	w       io.Writer
+	results []*scriptResult
+	extra   strings.Builder // output that belongs to no script
+	start   time.Time
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr,omitempty"`
+	Cases     []junitCase `xml:"testcase"`
+	SystemErr string      `xml:"system-err,omitempty"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Skipped   *junitMessage `xml:"skipped"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func (j *junitReporter) result(r *scriptResult) {
+	if j.results == nil || r.start.Before(j.start) {
+		j.start = r.start
+	}
+	j.results = append(j.results, r)
+}
+
+func (j *junitReporter) output(text string) {
+	j.extra.WriteString(text)
+}
+
+func (j *junitReporter) done(failed bool, elapsed time.Duration) error {
+	suite := junitSuite{
+		Name:      reportPackage,
+		Tests:     len(j.results),
+		Time:      fmt.Sprintf("%.3f", elapsed.Seconds()),
+		SystemErr: j.extra.String(),
+	}
+	if !j.start.IsZero() {
+		suite.Timestamp = j.start.UTC().Format(time.RFC3339)
+	}
+	for _, r := range j.results {
+		c := junitCase{
+			Name:      r.name,
+			Classname: reportPackage,
+			Time:      fmt.Sprintf("%.3f", r.elapsed.Seconds()),
+			SystemOut: string(r.output),
+		}
+		switch r.action {
+		case "fail":
+			suite.Failures++
+			c.Failure = &junitMessage{Message: firstLine(r.output, "FAIL: ", "Failed"), Body: string(r.output)}
+			c.SystemOut = ""
+		case "skip":
+			suite.Skipped++
+			c.Skipped = &junitMessage{Message: firstLine(r.output, "SKIP: ", "Skipped")}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	doc := junitSuites{
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitSuite{suite},
+	}
+	if _, err := io.WriteString(j.w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(j.w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(j.w, "\n")
+	return err
+}
+
+// tapReporter writes results in the Test Anything Protocol, version 13.
+// The plan comes last, since the number of scripts isn't known upfront.
+type tapReporter struct {
+	w       io.Writer
+	n       int
+	started bool
+}
+
+func (t *tapReporter) header() {
+	if !t.started {
+		t.started = true
+		io.WriteString(t.w, "TAP version 13\n")
+	}
+}
+
+// diagnostics writes output as TAP comment lines.
+func (t *tapReporter) diagnostics(output []byte) {
+	for _, line := range lines(output) {
+		fmt.Fprintf(t.w, "# %s", line)
+	}
+}
+
+func (t *tapReporter) result(r *scriptResult) {
+	t.header()
+	t.n++
+	switch r.action {
+	case "fail":
+		fmt.Fprintf(t.w, "not ok %d - %s\n", t.n, r.name)
+	case "skip":
+		fmt.Fprintf(t.w, "ok %d - %s # SKIP %s\n", t.n, r.name, firstLine(r.output, "SKIP: ", ""))
+	default:
+		fmt.Fprintf(t.w, "ok %d - %s\n", t.n, r.name)
+	}
+	fmt.Fprintf(t.w, "  ---\n  duration_ms: %.3f\n  ...\n", float64(r.elapsed.Microseconds())/1000)
+	t.diagnostics(r.output)
+}
+
+func (t *tapReporter) output(text string) {
+	t.header()
+	t.diagnostics([]byte(text))
+}
+
+func (t *tapReporter) done(failed bool, elapsed time.Duration) error {
+	t.header()
+	_, err := fmt.Fprintf(t.w, "1..%d\n", t.n)
+	return err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gfanton/testscript"
+)
+
+// reportScripts writes a passing, a failing and a skipped script to a
+// temporary directory and returns the set holding them.
+func reportScripts(t *testing.T) []scriptSet {
+	dir := t.TempDir()
+	scripts := map[string]string{
+		"a_pass": "exists $WORK\n",
+		"b_fail": "exists missing\n",
+		"c_skip": "skip 'not today'\n",
+	}
+	var files []string
+	for name, script := range scripts {
+		file := filepath.Join(dir, name+".tsar")
+		if err := os.WriteFile(file, []byte(script), 0666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	slices.Sort(files)
+	return []scriptSet{{params: testscript.Params{ContinueOnError: true}, files: files}}
+}
+
+func runReport(t *testing.T, format string) string {
+	var out bytes.Buffer
+	rep, err := newReporter(format, &out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := runScripts(rep, 1, reportScripts(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Errorf("runScripts succeeded despite a failing script")
+	}
+	return out.String()
+}
+
+func TestReportJSON(t *testing.T) {
+	out := runReport(t, "json")
+	var actions []string
+	dec := json.NewDecoder(strings.NewReader(out))
+	for dec.More() {
+		var e testEvent
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("decoding %s: %v", out, err)
+		}
+		if e.Package != reportPackage || e.Time.IsZero() {
+			t.Errorf("bad event %+v", e)
+		}
+		if e.Action != "output" {
+			actions = append(actions, e.Test+":"+e.Action)
+		} else if !strings.HasSuffix(e.Output, "\n") {
+			t.Errorf("output event %q does not end in a newline", e.Output)
+		}
+	}
+	want := "a_pass:run a_pass:pass b_fail:run b_fail:fail c_skip:run c_skip:skip :fail"
+	if got := strings.Join(actions, " "); got != want {
+		t.Errorf("got actions %s, want %s", got, want)
+	}
+	if !strings.Contains(out, `"Output":"--- SKIP: c_skip (`) {
+		t.Errorf("missing skip summary output:\n%s", out)
+	}
+}
+
+func TestReportJUnit(t *testing.T) {
+	out := runReport(t, "junit")
+	var doc junitSuites
+	if err := xml.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatalf("parsing %s: %v", out, err)
+	}
+	if doc.Tests != 3 || doc.Failures != 1 || doc.Skipped != 1 || len(doc.Suites) != 1 {
+		t.Fatalf("unexpected totals in:\n%s", out)
+	}
+	cases := doc.Suites[0].Cases
+	if len(cases) != 3 || cases[1].Name != "b_fail" || cases[1].Failure == nil || cases[2].Skipped == nil {
+		t.Fatalf("unexpected test cases in:\n%s", out)
+	}
+	if msg := cases[1].Failure.Message; !strings.Contains(msg, "missing") {
+		t.Errorf("failure message %q does not name the missing file", msg)
+	}
+	if msg := cases[2].Skipped.Message; msg != "not today" {
+		t.Errorf("skip message is %q, want %q", msg, "not today")
+	}
+}
+
+func TestReportTAP(t *testing.T) {
+	out := runReport(t, "tap")
+	var results []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "ok ") || strings.HasPrefix(line, "not ok ") || strings.HasPrefix(line, "1..") || strings.HasPrefix(line, "TAP ") {
+			results = append(results, line)
+		}
+	}
+	want := []string{
+		"TAP version 13",
+		"ok 1 - a_pass",
+		"not ok 2 - b_fail",
+		"ok 3 - c_skip # SKIP not today",
+		"1..3",
+	}
+	if strings.Join(results, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s\nfull output:\n%s", strings.Join(results, "\n"), strings.Join(want, "\n"), out)
+	}
+}
+
+func TestReportFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "report.json")
+	cfg := &config{format: "json", reportFile: file}
+	var stdout bytes.Buffer
+	rep, closeReport, err := cfg.newReporter(&stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runScripts(rep, 1, reportScripts(t))
+	if err := closeReport(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Action":"fail","Package":"tsar","Test":"b_fail"`) {
+		t.Errorf("report file lacks the failure:\n%s", data)
+	}
+	if !strings.Contains(stdout.String(), "--- FAIL: b_fail (") || strings.Contains(stdout.String(), "a_pass") {
+		t.Errorf("unexpected text output:\n%s", stdout.String())
+	}
+
+	cfg = &config{format: "yaml", reportFile: filepath.Join(t.TempDir(), "report.yaml")}
+	if _, _, err := cfg.newReporter(&stdout); err == nil {
+		t.Errorf("unknown format accepted")
+	}
+	if _, err := os.Stat(cfg.reportFile); !os.IsNotExist(err) {
+		t.Errorf("report file left behind for unknown format")
+	}
+}
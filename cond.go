@@ -0,0 +1,319 @@
+package testscript
+
+import (
+	"fmt"
+	"go/version"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Conditions maps condition names to their implementations, for use in
+// Params.Conditions.
+//
+// A condition may take an argument, given after a colon: [exec:docker]
+// calls the "exec" condition with arg "docker". Conditions used without
+// an argument get the empty string. The condition is satisfied if the
+// function returns true; an error fails the script.
+type Conditions map[string]func(ts *TestScript, arg string) (bool, error)
+
+// builtinConds holds the conditions available to every script, unless
+// Params.Conditions defines a condition of the same name.
+var builtinConds = Conditions{
+	"short":   noArg(func() bool { return testing.Short() }),
+	"windows": noArg(func() bool { return runtime.GOOS == "windows" }),
+	"darwin":  noArg(func() bool { return runtime.GOOS == "darwin" }),
+	"linux":   noArg(func() bool { return runtime.GOOS == "linux" }),
+	"unix":    noArg(func() bool { return slices.Contains(unixOS, runtime.GOOS) }),
+	"root":    noArg(func() bool { return os.Geteuid() == 0 }),
+	"arch": needArg(func(ts *TestScript, arch string) bool {
+		return runtime.GOARCH == arch
+	}),
+	"env": needArg(func(ts *TestScript, key string) bool {
+		_, ok := ts.env.lookup(key)
+		return ok
+	}),
+	"exec": needArg(func(ts *TestScript, prog string) bool {
+		path, err := ts.lookPath(prog)
+		if err != nil {
+			return false
+		}
+		_, err = os.Stat(ts.MkAbs(path))
+		return err == nil
+	}),
+}
+
+// builtinCondArgs describes the argument of the built-in conditions that
+// take one, for listing the available conditions.
+var builtinCondArgs = map[string]string{
+	"arch": "GOARCH",
+	"env":  "VAR",
+	"exec": "PROGRAM",
+}
+
+// unixOS lists the values of GOOS that satisfy the unix build constraint.
+var unixOS = []string{
+	"aix", "android", "darwin", "dragonfly", "freebsd", "hurd", "illumos",
+	"ios", "linux", "netbsd", "openbsd", "solaris",
+}
+
+// noArg returns a condition that takes no argument and holds when f
+// returns true.
+func noArg(f func() bool) func(*TestScript, string) (bool, error) {
+	return func(ts *TestScript, arg string) (bool, error) {
+		if arg != "" {
+			return false, fmt.Errorf("condition takes no argument")
+		}
+		return f(), nil
+	}
+}
+
+// needArg returns a condition that requires an argument and holds when f
+// returns true for it.
+func needArg(f func(ts *TestScript, arg string) bool) func(*TestScript, string) (bool, error) {
+	return func(ts *TestScript, arg string) (bool, error) {
+		if arg == "" {
+			return false, fmt.Errorf("condition requires an argument")
+		}
+		return f(ts, arg), nil
+	}
+}
+
+// condition evaluates whether a condition should be satisfied.
+//
+// A leading '!' negates the condition. Otherwise, the condition is looked
+// up in Params.Conditions, then among the built-in conditions; go1.N holds
+// when the Go release in use is at least 1.N. Params.Condition, if set,
+// evaluates any condition found in neither.
+func (ts *TestScript) condition(cond string) (bool, error) {
+	if c, ok := strings.CutPrefix(cond, "!"); ok {
+		ok, err := ts.condition(c)
+		return !ok, err
+	}
+	name, arg, _ := strings.Cut(cond, ":")
+	f := ts.params.Conditions[name]
+	if f == nil {
+		f = builtinConds[name]
+	}
+	if f != nil {
+		ok, err := f(ts, arg)
+		if err != nil {
+			return false, fmt.Errorf("[%s]: %v", cond, err)
+		}
+		return ok, nil
+	}
+	if strings.HasPrefix(cond, "go1.") && version.IsValid(cond) {
+		// Development versions don't have a comparable version number;
+		// assume they are recent enough.
+		v := runtime.Version()
+		return !version.IsValid(v) || version.Compare(v, cond) >= 0, nil
+	}
+	if ts.params.Condition != nil {
+		return ts.params.Condition(cond)
+	}
+	return false, fmt.Errorf("unknown condition %q; available conditions: %s", cond, strings.Join(ts.conditionNames(), ", "))
+}
+
+// conditionNames returns the names of the available conditions, sorted,
+// with a placeholder for the argument of those that take one.
+func (ts *TestScript) conditionNames() []string {
+	var names []string
+	for name := range builtinConds {
+		if _, ok := ts.params.Conditions[name]; ok {
+			continue
+		}
+		if arg, ok := builtinCondArgs[name]; ok {
+			name += ":" + arg
+		}
+		names = append(names, name)
+	}
+	for name := range ts.params.Conditions {
+		names = append(names, name)
+	}
+	names = append(names, "go1.N")
+	slices.Sort(names)
+	return names
+}
+
+// parseConds parses the conditions in brackets at the start of line and
+// returns them with the rest of the line.
+func parseConds(line string) ([]condExpr, string, error) {
+	var conds []condExpr
+	for strings.HasPrefix(line, "[") {
+		i := strings.Index(line, "]")
+		if i < 0 {
+			return nil, "", fmt.Errorf("unterminated condition")
+		}
+		cond, err := parseCondExpr(line[1:i])
+		if err != nil {
+			return nil, "", err
+		}
+		conds = append(conds, cond)
+		line = strings.TrimSpace(line[i+1:])
+	}
+	return conds, line, nil
+}
+
+// evalConds reports whether all the conditions hold, evaluating them in
+// order up to the first that doesn't.
+func (ts *TestScript) evalConds(conds []condExpr) (bool, error) {
+	for _, cond := range conds {
+		if ok, err := cond.eval(ts); !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// A condExpr is a parsed condition expression, the text between the
+// brackets of a condition such as [linux || (darwin && !short)].
+//
+// The operators are ! (not), && (and) and || (or), from the highest
+// precedence to the lowest, and parentheses group. A comma also means
+// and, binding like &&, so [!a,b] holds when a doesn't and b does.
+type condExpr interface {
+	eval(ts *TestScript) (bool, error)
+}
+
+type (
+	condName string // a condition evaluated by TestScript.condition
+	condNot  struct{ x condExpr }
+	condAnd  struct{ x, y condExpr }
+	condOr   struct{ x, y condExpr }
+)
+
+func (c condName) eval(ts *TestScript) (bool, error) { return ts.condition(string(c)) }
+
+func (c condNot) eval(ts *TestScript) (bool, error) {
+	ok, err := c.x.eval(ts)
+	return !ok, err
+}
+
+func (c condAnd) eval(ts *TestScript) (bool, error) {
+	if ok, err := c.x.eval(ts); !ok || err != nil {
+		return false, err
+	}
+	return c.y.eval(ts)
+}
+
+func (c condOr) eval(ts *TestScript) (bool, error) {
+	if ok, err := c.x.eval(ts); ok || err != nil {
+		return ok, err
+	}
+	return c.y.eval(ts)
+}
+
+// A condParser parses a condition expression.
+type condParser struct {
+	text string // the whole expression, for error messages
+	pos  int    // offset of the next token in text
+	tok  string // next token: an operator, a name, or "" at the end
+	err  error
+}
+
+// parseCondExpr parses the condition expression text.
+func parseCondExpr(text string) (condExpr, error) {
+	p := &condParser{text: text}
+	p.next()
+	x := p.or()
+	if p.err == nil && p.tok != "" {
+		p.unexpected()
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return x, nil
+}
+
+// fail records the first syntax error, pointing at the current token.
+func (p *condParser) fail(format string, args ...any) {
+	if p.err != nil {
+		return
+	}
+	where := "at end"
+	if p.tok != "" {
+		where = fmt.Sprintf("at column %d", p.pos+1)
+	}
+	p.err = fmt.Errorf("bad condition [%s]: %s %s", p.text, fmt.Sprintf(format, args...), where)
+}
+
+// unexpected reports the current token as out of place.
+func (p *condParser) unexpected() {
+	if p.tok == "&" || p.tok == "|" {
+		p.fail("unexpected %q (use %s%s)", p.tok, p.tok, p.tok)
+		return
+	}
+	p.fail("unexpected %q", p.tok)
+}
+
+// next advances to the next token.
+func (p *condParser) next() {
+	p.pos += len(p.tok)
+	for p.pos < len(p.text) && (p.text[p.pos] == ' ' || p.text[p.pos] == '\t') {
+		p.pos++
+	}
+	rest := p.text[p.pos:]
+	switch {
+	case rest == "":
+		p.tok = ""
+	case strings.HasPrefix(rest, "&&"), strings.HasPrefix(rest, "||"):
+		p.tok = rest[:2]
+	case strings.ContainsRune("!(),&|", rune(rest[0])):
+		p.tok = rest[:1]
+	default:
+		end := strings.IndexAny(rest, " \t!(),&|")
+		if end < 0 {
+			end = len(rest)
+		}
+		p.tok = rest[:end]
+	}
+}
+
+// or parses a sequence of operands joined by ||.
+func (p *condParser) or() condExpr {
+	x := p.and()
+	for p.err == nil && p.tok == "||" {
+		p.next()
+		x = condOr{x, p.and()}
+	}
+	return x
+}
+
+// and parses a sequence of operands joined by && or a comma.
+func (p *condParser) and() condExpr {
+	x := p.unary()
+	for p.err == nil && (p.tok == "&&" || p.tok == ",") {
+		p.next()
+		x = condAnd{x, p.unary()}
+	}
+	return x
+}
+
+// unary parses a condition name, a negation or a parenthesized
+// expression.
+func (p *condParser) unary() condExpr {
+	switch p.tok {
+	case "!":
+		p.next()
+		return condNot{p.unary()}
+	case "(":
+		p.next()
+		x := p.or()
+		if p.err == nil && p.tok != ")" {
+			p.fail("missing )")
+		}
+		p.next()
+		return x
+	case "", ")", "&&", "||", ",":
+		p.fail("missing condition")
+		return nil
+	case "&", "|":
+		p.unexpected()
+		return nil
+	}
+	x := condName(p.tok)
+	p.next()
+	return x
+}
@@ -0,0 +1,112 @@
+package testscript
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestConditions(t *testing.T) {
+	var legacy []string
+	p := Params{
+		Conditions: Conditions{
+			"feature": func(ts *TestScript, arg string) (bool, error) {
+				return arg == "on", nil
+			},
+		},
+		Condition: func(cond string) (bool, error) {
+			legacy = append(legacy, cond)
+			return cond == "legacy", nil
+		},
+	}
+	rt := runScript(t, p, `env R=
+[feature:on] env R=${R}a
+[feature:off] env R=${R}x
+[!legacy] env R=${R}x
+[!other] env R=${R}b
+[arch:`+runtime.GOARCH+`] env R=${R}c
+env R
+stdout '^abc$'
+`)
+	if rt.failed {
+		t.Fatalf("script failed: %s\n%s", rt.fatal, rt.logs.String())
+	}
+	if strings.Join(legacy, " ") != "legacy other" {
+		t.Errorf("Params.Condition called for %q, want only the conditions it defines", legacy)
+	}
+
+	tests := []struct {
+		cond string
+		want string
+	}{
+		{"nope", `unknown condition "nope"; available conditions: arch:GOARCH, darwin, env:VAR, exec:PROGRAM, feature, go1.N, linux, root, short, unix, windows`},
+		{"exec", "[exec]: condition requires an argument"},
+		{"linux:x", "[linux:x]: condition takes no argument"},
+	}
+	for _, tt := range tests {
+		rt := runScript(t, Params{Conditions: p.Conditions}, "["+tt.cond+"] stop\n")
+		if want := "script:1: " + tt.want; rt.fatal != want {
+			t.Errorf("[%s]: failure %q, want %q", tt.cond, rt.fatal, want)
+		}
+	}
+}
+
+func TestCondExpr(t *testing.T) {
+	ts := &TestScript{params: Params{Conditions: Conditions{
+		"yes": func(*TestScript, string) (bool, error) { return true, nil },
+		"no":  func(*TestScript, string) (bool, error) { return false, nil },
+	}}}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"yes", true},
+		{"!yes", false},
+		{"!!yes", true},
+		{"yes || no", true},
+		{"no || no", false},
+		{"yes && no", false},
+		{"yes&&yes", true},
+		{"!no,yes", true},
+		{"!yes,yes", false},
+		{"no || yes && yes", true},
+		{"(no || yes) && no", false},
+		{"no && yes || yes", true},
+		{"!(no || no)", true},
+		{" ( yes ) ", true},
+		// The right operand isn't evaluated when the left one decides.
+		{"yes || unknown", true},
+		{"no && unknown", false},
+	}
+	for _, tt := range tests {
+		x, err := parseCondExpr(tt.expr)
+		if err != nil {
+			t.Errorf("[%s]: %v", tt.expr, err)
+			continue
+		}
+		got, err := x.eval(ts)
+		if err != nil || got != tt.want {
+			t.Errorf("[%s] = %v, %v; want %v", tt.expr, got, err, tt.want)
+		}
+	}
+
+	errors := []struct {
+		expr string
+		want string
+	}{
+		{"", "bad condition []: missing condition at end"},
+		{"linux ||", "bad condition [linux ||]: missing condition at end"},
+		{"linux || && darwin", "bad condition [linux || && darwin]: missing condition at column 10"},
+		{"(linux", "bad condition [(linux]: missing ) at end"},
+		{"linux)", `bad condition [linux)]: unexpected ")" at column 6`},
+		{"linux | darwin", `bad condition [linux | darwin]: unexpected "|" (use ||) at column 7`},
+		{"linux darwin", `bad condition [linux darwin]: unexpected "darwin" at column 7`},
+		{"!", "bad condition [!]: missing condition at end"},
+	}
+	for _, tt := range errors {
+		_, err := parseCondExpr(tt.expr)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("[%s]: error %v, want %s", tt.expr, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package testscript
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupCoverage chooses the directory in which programs run by the
+// script write their coverage data, and returns it, or "" if coverage is
+// not collected.
+//
+// With Params.CoverDir, it is CoverDir/<script name>, and the data stays
+// there. Otherwise, if the test binary itself collects coverage, as with
+// go test -cover, it is a temporary directory whose data mergeCoverage
+// moves to the test binary's coverage directory when the script ends, so
+// that go test includes it in the reported coverage.
+func (ts *TestScript) setupCoverage() (string, error) {
+	if ts.params.CoverDir != "" {
+		dir := filepath.Join(ts.params.CoverDir, filepath.FromSlash(ts.name))
+		return dir, os.MkdirAll(dir, 0777)
+	}
+	if testCoverDir() == "" {
+		return "", nil
+	}
+	dir, err := os.MkdirTemp("", "tsar-cover-")
+	if err != nil {
+		return "", err
+	}
+	ts.mergeCoverDir = dir
+	return dir, nil
+}
+
+// testCoverDir returns the directory in which the test binary writes its
+// coverage data, or "" if it doesn't collect coverage. Tests replace it.
+var testCoverDir = func() string {
+	if testing.CoverMode() == "" {
+		return ""
+	}
+	f := flag.Lookup("test.gocoverdir")
+	if f == nil {
+		return ""
+	}
+	return f.Value.String()
+}
+
+// mergeCoverage moves the coverage data written by the script's programs
+// to the test binary's coverage directory; see setupCoverage.
+func (ts *TestScript) mergeCoverage() {
+	dir := ts.mergeCoverDir
+	if dir == "" {
+		return
+	}
+	ts.mergeCoverDir = ""
+	defer removeAll(dir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		ts.t.Fatalf("merging coverage: %v", err)
+		return
+	}
+	dst := testCoverDir()
+	for _, e := range entries {
+		target := filepath.Join(dst, e.Name())
+		if _, err := os.Stat(target); err == nil {
+			// Metadata files are named after their contents' hash, so
+			// an existing one is identical.
+			continue
+		}
+		if err := moveFile(filepath.Join(dir, e.Name()), target); err != nil {
+			ts.t.Fatalf("merging coverage: %v", err)
+			return
+		}
+	}
+}
+
+// moveFile moves the file src to dst, copying it when it can't simply be
+// renamed, as across file systems.
+func moveFile(src, dst string) error {
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
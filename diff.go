@@ -0,0 +1,190 @@
+package testscript
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+// in a unified diff.
+const diffContext = 3
+
+// maxDiffEdits bounds the number of line insertions and deletions
+// diffLines looks for. Its memory use grows with the square of that
+// number, and a longer diff would be too large to read anyway.
+const maxDiffEdits = 1000
+
+// A diffOp is a line of an edit script: kept (' '), deleted ('-') or
+// inserted ('+').
+type diffOp struct {
+	kind byte
+	text string // line, including its trailing newline if it has one
+}
+
+// unifiedDiff returns a unified diff turning text1, named name1, into
+// text2, named name2, or "" if they are equal. Hunk headers give the line
+// numbers of each change in both texts. If the texts differ in too many
+// lines, it only says so.
+func unifiedDiff(name1, text1, name2, text2 string) string {
+	if text1 == text2 {
+		return ""
+	}
+	lines1, lines2 := splitLines(text1), splitLines(text2)
+	ops, ok := diffLines(lines1, lines2)
+	if !ok {
+		return fmt.Sprintf("%s (%d lines) and %s (%d lines) differ in more than %d lines; diff omitted\n",
+			name1, len(lines1), name2, len(lines2), maxDiffEdits)
+	}
+
+	// line1[i] and line2[i] are the numbers of lines of each text that
+	// come before ops[i].
+	line1 := make([]int, len(ops)+1)
+	line2 := make([]int, len(ops)+1)
+	for i, op := range ops {
+		line1[i+1], line2[i+1] = line1[i], line2[i]
+		if op.kind != '+' {
+			line1[i+1]++
+		}
+		if op.kind != '-' {
+			line2[i+1]++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", name1, name2)
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		// Changes separated by at most 2*diffContext unchanged lines
+		// share a hunk.
+		last := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			} else if j-last > 2*diffContext {
+				break
+			}
+		}
+		start := max(i-diffContext, 0)
+		end := min(last+diffContext+1, len(ops))
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n",
+			hunkRange(line1[start], line1[end]-line1[start]),
+			hunkRange(line2[start], line2[end]-line2[start]))
+		for _, op := range ops[start:end] {
+			b.WriteByte(op.kind)
+			b.WriteString(op.text)
+			if !strings.HasSuffix(op.text, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return b.String()
+}
+
+// hunkRange formats the range of n lines following line start (counted
+// from 0) as in a unified diff hunk header.
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// splitLines splits text into lines, keeping their newlines.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns a shortest edit script turning a into b, computed
+// with Myers' algorithm after setting aside any common prefix and suffix.
+// It gives up, returning false, if the script would need more than
+// maxDiffEdits insertions and deletions.
+func diffLines(a, b []string) ([]diffOp, bool) {
+	var prefix, suffix []diffOp
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, diffOp{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append(suffix, diffOp{' ', a[len(a)-1]})
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	slices.Reverse(suffix)
+
+	// v[k+off] is the furthest x reached on diagonal k = x-y; trace[d]
+	// holds v as it was before step d, for diagonals -d..d.
+	n, m := len(a), len(b)
+	off := n + m + 1
+	v := make([]int, 2*off+1)
+	var trace [][]int
+	d := 0
+search:
+	for ; ; d++ {
+		if d > maxDiffEdits {
+			return nil, false
+		}
+		trace = append(trace, slices.Clone(v[off-d:off+d+1]))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+off] < v[k+1+off]) {
+				x = v[k+1+off]
+			} else {
+				x = v[k-1+off] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[k+off] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk back from the end, recording the edits in reverse.
+	var ops []diffOp
+	x, y := n, m
+	for ; d > 0; d-- {
+		prev := trace[d] // indexed by k+d
+		k := x - y
+		var pk int
+		if k == -d || (k != d && prev[k-1+d] < prev[k+1+d]) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := prev[pk+d]
+		py := px - pk
+		for x > px && y > py {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if x == px {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, diffOp{' ', a[x-1]})
+		x, y = x-1, y-1
+	}
+	slices.Reverse(ops)
+	return append(append(prefix, ops...), suffix...), true
+}
@@ -0,0 +1,141 @@
+package testscript
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name         string
+		text1, text2 string
+		want         string
+	}{
+		{"Equal", "a\nb\n", "a\nb\n", ""},
+		{
+			"Change",
+			"a\nb\nc\n",
+			"a\nB\nc\n",
+			`--- old
++++ new
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+`,
+		},
+		{
+			"Context",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n",
+			"1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\nsixteen\n",
+			`--- old
++++ new
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -13,4 +13,4 @@
+ 13
+ 14
+ 15
+-16
++sixteen
+`,
+		},
+		{
+			"Insert",
+			"",
+			"a\n",
+			`--- old
++++ new
+@@ -0,0 +1 @@
++a
+`,
+		},
+		{
+			"NoNewline",
+			"a\nb",
+			"a\nb\n",
+			`--- old
++++ new
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++b
+`,
+		},
+		{
+			"Reorder",
+			"a\nb\nc\nd\n",
+			"b\nc\na\nd\ne\n",
+			`--- old
++++ new
+@@ -1,4 +1,5 @@
+-a
+ b
+ c
++a
+ d
++e
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unifiedDiff("old", tt.text1, "new", tt.text2)
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLinesApply(t *testing.T) {
+	// Applying the edit script to the first text must yield the second.
+	pairs := [][2]string{
+		{"a b c a b b a", "c b a b a c"},
+		{"x y z", "p q r"},
+		{"", "a a a"},
+		{"a a a", ""},
+	}
+	for _, p := range pairs {
+		a, b := strings.Fields(p[0]), strings.Fields(p[1])
+		var old, new []string
+		ops, ok := diffLines(a, b)
+		if !ok {
+			t.Fatalf("diffLines(%q, %q) gave up", p[0], p[1])
+		}
+		for _, op := range ops {
+			if op.kind != '+' {
+				old = append(old, op.text)
+			}
+			if op.kind != '-' {
+				new = append(new, op.text)
+			}
+		}
+		if strings.Join(old, " ") != p[0] || strings.Join(new, " ") != p[1] {
+			t.Errorf("diffLines(%q, %q) gives %q and %q", p[0], p[1], old, new)
+		}
+	}
+}
+
+func TestUnifiedDiffTooLong(t *testing.T) {
+	// Texts differing in every line would take quadratic memory to diff.
+	var b1, b2 strings.Builder
+	for i := range 6000 {
+		fmt.Fprintf(&b1, "old %d\n", i)
+		fmt.Fprintf(&b2, "new %d\n", i)
+	}
+	got := unifiedDiff("old", b1.String(), "new", b2.String())
+	want := "old (6000 lines) and new (6000 lines) differ in more than 1000 lines; diff omitted\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,69 @@
+package testscript
+
+import (
+	"runtime"
+	"strings"
+)
+
+// An environ is an ordered list of environment variables of the form
+// "key=value" holding at most one entry per key. Setting a key that is
+// already present replaces its value in place, so keys keep the position
+// at which they were first set. As on the host, keys are compared without
+// regard to case on Windows.
+type environ []string
+
+// newEnviron returns an environ holding the variables of kvs, in which a
+// later entry for a key overrides an earlier one. Entries without '=' are
+// dropped.
+func newEnviron(kvs []string) environ {
+	var e environ
+	for _, kv := range kvs {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			e.set(key, value)
+		}
+	}
+	return e
+}
+
+// index returns the index of key's entry in e, or -1.
+func (e environ) index(key string) int {
+	for i, kv := range e {
+		k, _, _ := strings.Cut(kv, "=")
+		if k == key || (runtime.GOOS == "windows" && strings.EqualFold(k, key)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookup returns the value of key and whether it is set.
+func (e environ) lookup(key string) (string, bool) {
+	if i := e.index(key); i >= 0 {
+		_, value, _ := strings.Cut(e[i], "=")
+		return value, true
+	}
+	return "", false
+}
+
+// set sets the value of key.
+func (e *environ) set(key, value string) {
+	if i := e.index(key); i >= 0 {
+		(*e)[i] = key + "=" + value
+		return
+	}
+	*e = append(*e, key+"="+value)
+}
+
+// unset removes key.
+func (e *environ) unset(key string) {
+	if i := e.index(key); i >= 0 {
+		*e = append((*e)[:i], (*e)[i+1:]...)
+	}
+}
+
+// with returns a copy of e in which key is set to value, leaving e as is.
+func (e environ) with(key, value string) environ {
+	c := append(environ(nil), e...)
+	c.set(key, value)
+	return c
+}
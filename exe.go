@@ -0,0 +1,94 @@
+package testscript
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// binDir is the directory of $WORK that holds the programs registered
+// with Main. It is put first in the scripts' PATH.
+const binDir = ".bin"
+
+// mainCommands holds the commands registered with Main, by name.
+var mainCommands map[string]func() int
+
+// testExecutable returns the path of the running test binary.
+var testExecutable = sync.OnceValues(os.Executable)
+
+// Main runs the tests in m after making each of the given commands
+// available to scripts as a program of the same name, so that a CLI can
+// be tested without building it first:
+//
+//	func TestMain(m *testing.M) {
+//		testscript.Main(m, map[string]func() int{
+//			"mytool": mytoolMain,
+//		})
+//	}
+//
+// Each script's work directory gets a .bin directory, put first in its
+// PATH, holding a link to the test binary for each command. When a
+// script runs "exec mytool --flag", the test binary starts again, finds
+// that it was invoked as mytool, and exits with the status mytoolMain
+// returns instead of running the tests. Main itself never returns.
+func Main(m *testing.M, commands map[string]func() int) {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	if main, ok := commands[name]; ok {
+		os.Exit(main())
+	}
+	mainCommands = commands
+	os.Exit(m.Run())
+}
+
+// installCommands links the commands registered with Main into the bin
+// directory of the work directory and returns its path, or "" if there
+// are no commands.
+func (ts *TestScript) installCommands() (string, error) {
+	if len(mainCommands) == 0 {
+		return "", nil
+	}
+	exe, err := testExecutable()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(ts.workdir, binDir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	for name := range mainCommands {
+		if runtime.GOOS == "windows" {
+			name += ".exe"
+		}
+		if err := linkExecutable(exe, filepath.Join(dir, name)); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// linkExecutable makes dst run the program src, with a symbolic link
+// where possible, and otherwise a hard link or a copy, as Windows may not
+// allow symbolic links.
+func linkExecutable(src, dst string) error {
+	if os.Symlink(src, dst) == nil || os.Link(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
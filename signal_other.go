@@ -0,0 +1,11 @@
+//go:build !unix
+
+package testscript
+
+import "os"
+
+// quitSignal returns the signal sent to programs still running at the
+// script's deadline. Without SIGQUIT, they are killed straight away.
+func quitSignal() os.Signal {
+	return os.Kill
+}
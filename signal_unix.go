@@ -0,0 +1,14 @@
+//go:build unix
+
+package testscript
+
+import (
+	"os"
+	"syscall"
+)
+
+// quitSignal returns the signal sent to programs still running at the
+// script's deadline. SIGQUIT makes Go programs dump their goroutines.
+func quitSignal() os.Signal {
+	return syscall.SIGQUIT
+}
@@ -35,9 +35,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -46,6 +51,13 @@ import (
 )
 
 // TestingT is the interface common to *testing.T and *testing.B.
+//
+// Scripts are run as subtests of the TestingT passed to Run when it is a
+// *testing.T, a *testing.B, or implements SubtestRunner, and each of them
+// runs whether or not others fail. Any other TestingT runs the scripts
+// directly, one after the other; as its failures are not isolated per
+// script, a failure ends the run unless Params.ContinueOnError is set, and
+// later scripts then stop at their first line.
 type TestingT interface {
 	Skip(args ...any)
 	Fatal(args ...any)
@@ -56,12 +68,35 @@ type TestingT interface {
 	Helper()
 }
 
+// A SubtestRunner is a TestingT that can run subtests, allowing harnesses
+// other than the testing package, such as the tsar command, to run each
+// script in isolation. Run runs f as a subtest called name, passing it the
+// TestingT of the subtest, and reports whether the subtest succeeded.
+//
+// If the subtest's TestingT has a Parallel method, it is called at the
+// start of each script when Params.Parallel is set, as with t.Parallel.
+//
+// If the SubtestRunner has a method StopOnFailure() bool that returns
+// true, a failing script keeps the later ones from running unless
+// Params.ContinueOnError is set.
+type SubtestRunner interface {
+	TestingT
+	Run(name string, f func(TestingT)) bool
+}
+
 // Params holds parameters for a call to Run.
 type Params struct {
 	// Dir is the directory holding the test scripts.
 	// All files in the directory with a .tsar extension are considered to be test scripts.
 	Dir string
 
+	// Recursive, if true, makes Run also look for scripts in the
+	// subdirectories of Dir, skipping those whose name starts with '.'.
+	// Scripts are then named after their path relative to Dir, without
+	// the .tsar extension, using forward slashes (for example
+	// "cli/basic"), including when they are passed to RunFiles.
+	Recursive bool
+
 	// Commands holds a map of command names to their implementations.
 	// When a command 'foo' is invoked, the function is called with the TestScript
 	// context, a boolean indicating whether the command was invoked with '!',
@@ -75,18 +110,38 @@ type Params struct {
 	// WorkdirRoot specifies the directory within which scripts' work
 	// directories will be created. Setting WorkdirRoot implies TestWork=true.
 	// If empty, the work directories will be created inside $TMPDIR.
+	//
+	// Each script gets a new directory with a unique name that starts with
+	// "tsar-" followed by the script name, so that concurrently running
+	// scripts never share a work directory.
 	WorkdirRoot string
 
+	// StableWorkdir, if true, gives each script the deterministic work
+	// directory WorkdirRoot/<script name> instead of a uniquely named one,
+	// which is convenient for collecting work directories as CI artifacts.
+	// Any existing directory at that path is removed first, so
+	// StableWorkdir requires WorkdirRoot to be set: the scripts would
+	// otherwise replace whatever directories of $TMPDIR share their
+	// names. Because the path depends only on the name, StableWorkdir
+	// implies RequireUniqueNames.
+	StableWorkdir bool
+
 	// Setup is called, if non-nil, to complete any setup required for the test.
 	// The working directory and environment variables are set up
 	// before calling Setup; see the package documentation for details.
 	// Setup is responsible for creating any files required by the script.
 	Setup func(*Env) error
 
+	// Conditions holds conditions that scripts can use in addition to
+	// the built-in ones, such as [linux] or [exec:docker]. A condition
+	// defined here replaces any built-in condition of the same name.
+	Conditions Conditions
+
 	// Condition is called, if non-nil, to determine whether a condition
-	// listed in a script file should be satisfied. It's called with the condition
-	// tag (without the surrounding []). The condition is satisfied if Condition
-	// returns true or nil.
+	// listed in a script file should be satisfied, when neither Conditions
+	// nor the built-in conditions define it. It's called with the condition
+	// tag (without the surrounding [] and any leading '!'). The condition
+	// is satisfied if Condition returns true and a nil error.
 	Condition func(cond string) (bool, error)
 
 	// RequireExplicitExec, if true, requires that commands be invoked
@@ -98,13 +153,99 @@ type Params struct {
 	// have unique base names (excluding extensions).
 	RequireUniqueNames bool
 
-	// ContinueOnError causes Run to continue executing tests after an error.
-	// If ContinueOnError is false (the default), any error stops execution
-	// of later tests.
+	// ContinueOnError causes Run to continue executing tests after an
+	// error. If ContinueOnError is false (the default), any error stops
+	// execution of later tests, unless the scripts run as independent
+	// subtests; see TestingT.
 	ContinueOnError bool
+
+	// Deadline, if non-zero, is the time by which every script must have
+	// completed. When the TestingT has a Deadline method, as *testing.T
+	// does, its deadline is honored too, less a grace period that leaves
+	// time to report the timeout before the test binary panics.
+	Deadline time.Time
+
+	// ScriptTimeout, if non-zero, limits how long each script may run.
+	//
+	// When a script runs out of time, programs started by exec receive
+	// SIGQUIT, so that Go programs dump their goroutines, and are killed
+	// shortly after if they don't exit. The script then fails, naming the
+	// line it was running. Custom commands that may block should honor
+	// TestScript.Context.
+	ScriptTimeout time.Duration
+
+	// RunPattern, if non-empty, is a regular expression selecting the
+	// scripts to run by name, like go test -run. SkipPattern, if non-empty,
+	// is a regular expression naming scripts not to run, like go test
+	// -skip. Neither is anchored.
+	RunPattern  string
+	SkipPattern string
+
+	// Tags, if non-empty, selects scripts by the tags listed in their
+	// header, on comment lines of the form
+	//
+	//	# tags: slow network
+	//
+	// among the comments that open the script. Only scripts carrying at
+	// least one of the listed tags run; a tag prefixed with '!' instead
+	// excludes the scripts that carry it, so {"!slow"} runs every script
+	// not tagged slow.
+	Tags []string
+
+	// UpdateScripts, if true, updates golden files in place: when
+	// "cmp stdout file" or "cmp stderr file" fails and file was written
+	// from a file section of the script and not modified since, the
+	// section is replaced with the actual output and the script file is
+	// rewritten when the script ends, instead of failing. The rest of the
+	// file, including the script and its comments, is left as is.
+	UpdateScripts bool
+
+	// PassEnv lists the host environment variables that scripts see.
+	// Scripts otherwise run in a hermetic environment, holding only
+	// WORK, PATH (taken from the host), a HOME that doesn't exist, a
+	// temporary directory inside $WORK, exe, the variables Setup sets and
+	// those the system needs to run programs (SYSTEMROOT, WINDIR, ComSpec
+	// and PATHEXT on Windows), so that they behave the same on every
+	// machine. Listed variables that are not set on the host are left
+	// unset; PassEnv can't change WORK or PATH.
+	PassEnv []string
+
+	// StrictEnv, if true, makes the expansion of a variable that is not
+	// set fail the script. By default, it expands to the empty string.
+	StrictEnv bool
+
+	// StrictArchive, if true, fails scripts whose trailing archive holds
+	// lines that look like script commands, before they start. Such a line
+	// most likely follows a file section that lacks its closing "-- end --"
+	// line, and is extracted as file data instead of running, letting the
+	// script pass without checking anything. The check is off by default
+	// as files such as shell scripts may legitimately hold such lines.
+	StrictArchive bool
+
+	// CoverDir, if non-empty, is the directory in which programs run by
+	// scripts and built with -cover (go build -cover) write their coverage
+	// data: each script's programs get GOCOVERDIR set to
+	// CoverDir/<script name>. The data can then be inspected or merged
+	// with go tool covdata.
+	//
+	// If CoverDir is empty and the tests run with go test -cover, each
+	// script's programs write their data to a temporary directory instead,
+	// which is merged into the test's own coverage when the script ends,
+	// so that it counts towards the coverage go test reports. This
+	// includes the commands registered with Main.
+	CoverDir string
+
+	// Parallel, if true, runs each script as a parallel subtest by calling
+	// t.Parallel, so that scripts run concurrently up to the -test.parallel
+	// limit. It has no effect unless the subtests' TestingT has a Parallel
+	// method.
+	Parallel bool
 }
 
 // An Env holds the environment variables to use for a test script invocation.
+//
+// Values lists the variables as "key=value" pairs, one per key. If Setup
+// adds an entry for a key that is already present, the later entry wins.
 type Env struct {
 	WorkDir string
 	Values  []string
@@ -113,19 +254,19 @@ type Env struct {
 
 // Getenv retrieves the value of the environment variable named by the key.
 func (e *Env) Getenv(key string) string {
-	for _, kv := range e.Values {
-		if i := strings.Index(kv, "="); i >= 0 {
-			if kv[:i] == key {
-				return kv[i+1:]
-			}
-		}
-	}
-	return ""
+	value, _ := environ(e.Values).lookup(key)
+	return value
 }
 
-// Setenv sets the value of the environment variable named by the key.
+// Setenv sets the value of the environment variable named by the key,
+// replacing any previous value.
 func (e *Env) Setenv(key, value string) {
-	e.Values = append(e.Values, key+"="+value)
+	(*environ)(&e.Values).set(key, value)
+}
+
+// Unsetenv removes the environment variable named by the key.
+func (e *Env) Unsetenv(key string) {
+	(*environ)(&e.Values).unset(key)
 }
 
 // TestScript holds execution state for a single test script.
@@ -134,33 +275,45 @@ type TestScript struct {
 	testDir    string // directory holding the test script
 	workdir    string // temporary work directory ($WORK)
 	log        bytes.Buffer
-	mark       int    // offset of next log truncation
-	cd         string // current directory during test execution; initially $WORK
-	name       string // short name of test ("foo")
-	file       string // full path to test file
-	lineno     int    // line number currently being processed
-	line       string // line currently being processed (for error messages)
-	env        []string
-	envMap     map[string]string // memo of env var key → value mapping
-	stdout     string            // standard output from last 'exec' command
-	stderr     string            // standard error from last 'exec' command
-	stopped    bool              // test wants to stop early
+	mark       int       // offset of next log truncation
+	cd         string    // current directory during test execution; initially $WORK
+	name       string    // short name of test ("foo")
+	file       string    // full path to test file
+	lineno     int       // line number currently being processed
+	line       string    // line currently being processed (for error messages)
+	env        environ   // environment of the script and its programs
+	stdout     string    // standard output from last 'exec' command
+	stderr     string    // standard error from last 'exec' command
+	stdin      io.Reader // standard input for the next 'exec' command
+	mayFail    bool      // current command was prefixed with '?'
+	stopped    bool      // test wants to stop early
 	start      time.Time
-	background []backgroundCmd // backgrounded 'exec' commands
+	background []*backgroundCmd // backgrounded 'exec' commands
+	ctx        context.Context  // canceled at the script's deadline or end
+	cancel     context.CancelFunc
+	sections   map[string]scriptStep // file sections by the path they were written to
+	updates    map[int]txtar.File    // file sections to rewrite, by index
+	// mergeCoverDir holds coverage data to merge into the test binary's;
+	// see setupCoverage.
+	mergeCoverDir string
 
 	builtin map[string]func(*TestScript, bool, []string)
 	user    map[string]func(*TestScript, bool, []string) // external test commands; see Params.Commands
 	params  Params                                       // original parameters
 }
 
+// A backgroundCmd is a command started with a trailing '&' that runs
+// alongside the rest of the script until it is waited for.
 type backgroundCmd struct {
-	want   actionType
-	args   []string
-	cancel context.CancelFunc
-	wait   <-chan error
-	stdout strings.Builder
-	stderr strings.Builder
-	neg    bool
+	want    actionType
+	name    string // name given with '&name&', or empty
+	args    []string
+	cancel  context.CancelFunc
+	wait    <-chan error
+	stdout  strings.Builder
+	stderr  strings.Builder
+	neg     bool // command was prefixed with '!'
+	mayFail bool // command was prefixed with '?'
 }
 
 type actionType int
@@ -171,14 +324,21 @@ const (
 	actionStop
 )
 
+// execWaitDelay is how long to wait for a command's output to be closed
+// after the command has exited or been killed, and for a command that
+// was sent SIGQUIT at the script's deadline to exit before killing it.
+const execWaitDelay = time.Second
+
 // Run runs the test scripts in the given directory as subtests of t.
 func Run(t TestingT, p Params) {
-	files, err := filepath.Glob(filepath.Join(p.Dir, "*.tsar"))
+	files, err := findScripts(p.Dir, p.Recursive)
 	if err != nil {
 		t.Fatal(err)
+		return
 	}
 	if len(files) == 0 {
 		t.Fatal("no test script files found")
+		return
 	}
 	runFiles(t, p, files)
 }
@@ -189,23 +349,18 @@ func RunFiles(t TestingT, p Params, filenames ...string) {
 	runFiles(t, p, filenames)
 }
 
-// RunFilesStandalone runs the test scripts without using t.Run for subtest execution.
-// This is useful for command-line tools that don't need the full testing framework.
+// RunFilesStandalone runs the test scripts with the given file names.
+//
+// Deprecated: RunFiles accepts any TestingT; use it instead.
 func RunFilesStandalone(t TestingT, p Params, filenames ...string) {
-	runFilesStandalone(t, p, filenames)
+	runFiles(t, p, filenames)
 }
 
-// RunStandalone runs the test scripts in the given directory without using t.Run for subtest execution.
-// This is useful for command-line tools that don't need the full testing framework.
+// RunStandalone runs the test scripts in the given directory.
+//
+// Deprecated: Run accepts any TestingT; use it instead.
 func RunStandalone(t TestingT, p Params) {
-	files, err := filepath.Glob(filepath.Join(p.Dir, "*.tsar"))
-	if err != nil {
-		t.Fatal(err)
-	}
-	if len(files) == 0 {
-		t.Fatal("no test script files found")
-	}
-	runFilesStandalone(t, p, files)
+	Run(t, p)
 }
 
 func runFiles(t TestingT, p Params, filenames []string) {
@@ -213,22 +368,41 @@ func runFiles(t TestingT, p Params, filenames []string) {
 		name string
 		file string
 	}
+	if p.StableWorkdir && p.WorkdirRoot == "" {
+		t.Fatal("StableWorkdir requires WorkdirRoot")
+		return
+	}
+	match, err := newScriptFilter(p)
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
 	var tests []testCase
 	seen := make(map[string]bool)
 	for _, filename := range filenames {
-		name := strings.TrimSuffix(filepath.Base(filename), ".tsar")
-		if p.RequireUniqueNames {
+		name := scriptName(p, filename)
+		if ok, err := match(name, filename); err != nil {
+			t.Fatal(err)
+			return
+		} else if !ok {
+			continue
+		}
+		if p.RequireUniqueNames || p.StableWorkdir {
 			if seen[name] {
 				t.Fatalf("duplicate test name %q", name)
+				return
 			}
 			seen[name] = true
 		}
 		tests = append(tests, testCase{name, filename})
 	}
 
+	run, stopOnFailure := subtestRunner(t)
 	for _, tc := range tests {
-		tc := tc
-		t.(*testing.T).Run(tc.name, func(t *testing.T) {
+		ok := run(tc.name, func(t TestingT) {
+			if pt, ok := t.(interface{ Parallel() }); ok && p.Parallel {
+				pt.Parallel()
+			}
 			ts := &TestScript{
 				t:       t,
 				name:    tc.name,
@@ -242,51 +416,134 @@ func runFiles(t TestingT, p Params, filenames []string) {
 			defer ts.finalize()
 			ts.run()
 		})
+		if !ok && stopOnFailure && !p.ContinueOnError {
+			return
+		}
 	}
 }
 
-func runFilesStandalone(t TestingT, p Params, filenames []string) {
-	type testCase struct {
-		name string
-		file string
+// findScripts returns the .tsar files in dir and, if recursive is set,
+// in its subdirectories, in lexical order.
+func findScripts(dir string, recursive bool) ([]string, error) {
+	if !recursive {
+		return filepath.Glob(filepath.Join(dir, "*.tsar"))
 	}
-	var tests []testCase
-	seen := make(map[string]bool)
-	for _, filename := range filenames {
-		name := strings.TrimSuffix(filepath.Base(filename), ".tsar")
-		if p.RequireUniqueNames {
-			if seen[name] {
-				t.Fatalf("duplicate test name %q", name)
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
 			}
-			seen[name] = true
+			return nil
+		}
+		if strings.HasSuffix(path, ".tsar") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// scriptName returns the test name of the script in the given file: its
+// base name without extension or, with p.Recursive, its slash-separated
+// path relative to p.Dir.
+func scriptName(p Params, filename string) string {
+	if p.Recursive {
+		if rel, err := filepath.Rel(p.Dir, filename); err == nil && filepath.IsLocal(rel) {
+			return filepath.ToSlash(strings.TrimSuffix(rel, ".tsar"))
 		}
-		tests = append(tests, testCase{name, filename})
 	}
+	return strings.TrimSuffix(filepath.Base(filename), ".tsar")
+}
 
-	for _, tc := range tests {
-		t.Logf("=== RUN   %s", tc.name)
-		ts := &TestScript{
-			t:       t,
-			name:    tc.name,
-			file:    tc.file,
-			testDir: filepath.Dir(tc.file),
-			params:  p,
-			builtin: builtinCmds,
-			user:    p.Commands,
-			start:   time.Now(),
-		}
-		defer ts.finalize()
-		ts.run()
-		
-		if t.Failed() {
-			t.Logf("--- FAIL: %s", tc.name)
-			if !p.ContinueOnError {
-				return
-			}
+// newScriptFilter returns a function reporting whether the script with
+// the given name and file is selected by p's RunPattern, SkipPattern and
+// Tags.
+func newScriptFilter(p Params) (func(name, file string) (bool, error), error) {
+	var runRE, skipRE *regexp.Regexp
+	var err error
+	if p.RunPattern != "" {
+		if runRE, err = regexp.Compile(p.RunPattern); err != nil {
+			return nil, fmt.Errorf("invalid RunPattern: %v", err)
+		}
+	}
+	if p.SkipPattern != "" {
+		if skipRE, err = regexp.Compile(p.SkipPattern); err != nil {
+			return nil, fmt.Errorf("invalid SkipPattern: %v", err)
+		}
+	}
+	var want, exclude []string
+	for _, tag := range p.Tags {
+		if t, ok := strings.CutPrefix(tag, "!"); ok {
+			exclude = append(exclude, t)
 		} else {
-			t.Logf("--- PASS: %s", tc.name)
+			want = append(want, tag)
 		}
 	}
+	return func(name, file string) (bool, error) {
+		if runRE != nil && !runRE.MatchString(name) {
+			return false, nil
+		}
+		if skipRE != nil && skipRE.MatchString(name) {
+			return false, nil
+		}
+		if len(p.Tags) == 0 {
+			return true, nil
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return false, err
+		}
+		tags := scriptTags(data)
+		for _, t := range exclude {
+			if slices.Contains(tags, t) {
+				return false, nil
+			}
+		}
+		if len(want) == 0 {
+			return true, nil
+		}
+		for _, t := range want {
+			if slices.Contains(tags, t) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}, nil
+}
+
+// subtestRunner returns a function that runs f as a subtest of t called
+// name and reports whether it succeeded, and whether a failing subtest
+// should stop the run.
+func subtestRunner(t TestingT) (func(name string, f func(TestingT)) bool, bool) {
+	switch t := t.(type) {
+	case *testing.T:
+		return func(name string, f func(TestingT)) bool {
+			return t.Run(name, func(t *testing.T) { f(t) })
+		}, false
+	case *testing.B:
+		return func(name string, f func(TestingT)) bool {
+			return t.Run(name, func(b *testing.B) { f(b) })
+		}, false
+	case SubtestRunner:
+		st, ok := t.(interface{ StopOnFailure() bool })
+		return t.Run, ok && st.StopOnFailure()
+	}
+	// t has no notion of subtests: run each script directly against t,
+	// in sequence.
+	return func(name string, f func(TestingT)) bool {
+		t.Logf("=== RUN   %s", name)
+		f(t)
+		if t.Failed() {
+			t.Logf("--- FAIL: %s", name)
+			return false
+		}
+		t.Logf("--- PASS: %s", name)
+		return true
+	}, true
 }
 
 // setup sets up the test execution temporary directory and environment.
@@ -295,30 +552,46 @@ func (ts *TestScript) setup() {
 	ts.log.Reset()
 	ts.mark = 0
 	ts.cd = ""
-	ts.name = ""
 	ts.stdout = ""
 	ts.stderr = ""
+	ts.stdin = nil
 	ts.stopped = false
 	ts.start = StartTime
 	ts.background = nil
+	ts.sections = make(map[string]scriptStep)
+	ts.updates = nil
 
-	ts.workdir = filepath.Join(os.TempDir(), "tsar"+fmt.Sprint(os.Getpid())+fmt.Sprint(StartTime.Unix()))
-	if ts.params.WorkdirRoot != "" {
-		ts.workdir = filepath.Join(ts.params.WorkdirRoot, "tsar"+fmt.Sprint(os.Getpid())+fmt.Sprint(StartTime.Unix()))
-	}
-
-	if err := os.MkdirAll(ts.workdir, 0755); err != nil {
+	workdir, err := ts.makeWorkdir()
+	if err != nil {
 		ts.t.Fatal(err)
+		return
 	}
+	ts.workdir = workdir
 	if ts.params.WorkdirRoot != "" {
 		ts.params.TestWork = true
 	}
 	ts.cd = ts.workdir
 
+	// Make the commands registered with Main available first in PATH.
+	path := os.Getenv("PATH")
+	bin, err := ts.installCommands()
+	if err != nil {
+		ts.t.Fatal(err)
+		return
+	}
+	if bin != "" {
+		path = bin + string(filepath.ListSeparator) + path
+	}
+	coverDir, err := ts.setupCoverage()
+	if err != nil {
+		ts.t.Fatal(err)
+		return
+	}
+
 	// Set up environment.
-	ts.env = []string{
+	ts.env = environ{
 		"WORK=" + ts.workdir,
-		"PATH=" + os.Getenv("PATH"),
+		"PATH=" + path,
 		homeEnvName() + "=/no-home",
 		tempEnvName() + "=" + filepath.Join(ts.workdir, "tmp"),
 	}
@@ -327,39 +600,90 @@ func (ts *TestScript) setup() {
 	} else {
 		ts.env = append(ts.env, "exe=")
 	}
-	ts.envMap = make(map[string]string)
-	for _, kv := range ts.env {
-		if i := strings.Index(kv, "="); i >= 0 {
-			ts.envMap[kv[:i]] = kv[i+1:]
+	if coverDir != "" {
+		ts.env = append(ts.env, "GOCOVERDIR="+coverDir)
+	}
+	for _, key := range systemEnvNames() {
+		if value, ok := os.LookupEnv(key); ok {
+			ts.env.set(key, value)
+		}
+	}
+	for _, key := range ts.params.PassEnv {
+		if key == "WORK" || key == "PATH" {
+			continue
+		}
+		if value, ok := os.LookupEnv(key); ok {
+			ts.env.set(key, value)
 		}
 	}
 
 	// Create work directory.
 	if err := os.MkdirAll(ts.workdir, 0755); err != nil {
 		ts.t.Fatal(err)
+		return
 	}
 	if err := os.MkdirAll(filepath.Join(ts.workdir, "tmp"), 0755); err != nil {
 		ts.t.Fatal(err)
 	}
 }
 
+// makeWorkdir creates the script's work directory and returns its path.
+// By default the directory is freshly created with a unique name that
+// includes the script name; with Params.StableWorkdir it is instead
+// WorkdirRoot/<script name>, replacing any directory left by an earlier
+// run.
+func (ts *TestScript) makeWorkdir() (string, error) {
+	root := ts.params.WorkdirRoot
+	if root == "" {
+		root = os.TempDir()
+	}
+	if err := os.MkdirAll(root, 0777); err != nil {
+		return "", err
+	}
+	if ts.params.StableWorkdir && ts.params.WorkdirRoot != "" {
+		dir := filepath.Join(root, filepath.FromSlash(ts.name))
+		if err := removeAll(dir); err != nil {
+			return "", err
+		}
+		return dir, os.MkdirAll(dir, 0777)
+	}
+	// Subtest names may contain slashes, which MkdirTemp rejects.
+	name := strings.NewReplacer("/", "_", `\`, "_").Replace(ts.name)
+	return os.MkdirTemp(root, "tsar-"+name+"-")
+}
+
 // run executes the test script.
 func (ts *TestScript) run() {
+	if deadline := ts.deadline(); !deadline.IsZero() {
+		ts.ctx, ts.cancel = context.WithDeadline(context.Background(), deadline)
+	} else {
+		ts.ctx, ts.cancel = context.WithCancel(context.Background())
+	}
 	ts.setup()
+	if ts.t.Failed() {
+		return
+	}
 
 	// Read and parse the test script.
 	filename := ts.file
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		ts.t.Fatal(err)
+		return
 	}
-
-	// Check if this is a txtar archive.
-	var ar *txtar.Archive
-	if bytes.Contains(data, []byte("-- ")) {
-		ar = txtar.Parse(data)
-		data = ar.Comment
+	sf, err := parseScript(data)
+	if err != nil {
+		ts.t.Fatalf("parsing %s: %v", filename, err)
+		return
 	}
+	if ts.params.StrictArchive {
+		if lineno, line := sf.strayCommand(ts.isCommand); lineno > 0 {
+			ts.t.Fatalf("script:%d: %q looks like a command but is part of the trailing archive; close the file section above it with \"-- %s --\" to run it", lineno, line, endMarker)
+			return
+		}
+	}
+	// Apply updates even if a later line fails the script.
+	defer ts.updateScript(data)
 
 	if ts.params.Setup != nil {
 		env := &Env{
@@ -369,64 +693,181 @@ func (ts *TestScript) run() {
 		}
 		if err := ts.params.Setup(env); err != nil {
 			ts.t.Fatalf("setup failed: %v", err)
+			return
 		}
-		ts.env = env.Values
-		ts.refreshEnvMap()
+		ts.env = newEnviron(env.Values)
 	}
 
-	// Extract archive files if present.
-	if ar != nil {
-		for _, f := range ar.Files {
-			name := f.Name
-			ts.mkabs(filepath.Dir(name))
-			if err := os.WriteFile(ts.mkabs(name), f.Data, 0666); err != nil {
-				ts.t.Fatal(err)
-			}
+	// Extract the trailing archive into $WORK.
+	for _, step := range sf.archive {
+		if err := ts.writeSection(ts.workdir, step); err != nil {
+			ts.t.Fatal(err)
+			return
 		}
 	}
 
-	script := string(data)
-	// Execute script line by line.
-	for script != "" {
-		line, rest := getLine(script)
-		script = rest
-		ts.parseLine(line)
-		if ts.t.Failed() || ts.stopped {
+	if lineno, err := checkBlocks(sf.steps); err != nil {
+		ts.t.Fatalf("script:%d: %v", lineno, err)
+		return
+	}
+
+	// Execute the script line by line, writing inline file sections
+	// relative to the current directory as they are reached, and
+	// skipping the steps of if blocks that don't run.
+	var runs []bool // whether each enclosing if block runs, innermost last
+	for _, step := range sf.steps {
+		ts.lineno = step.lineno
+		if step.file == nil {
+			if kw, rest := blockKeyword(step.line); kw != "" {
+				runs = ts.block(runs, kw, rest)
+				if ts.t.Failed() {
+					break
+				}
+				continue
+			}
+		}
+		if len(runs) > 0 && !runs[len(runs)-1] {
+			continue
+		}
+		if step.file != nil {
+			if err := ts.writeSection(ts.cd, step); err != nil {
+				ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+			}
+		} else {
+			ts.parseLine(step.line)
+		}
+		if ts.t.Failed() || ts.timedOut() || ts.stopped {
 			break
 		}
 	}
 }
 
+// deadline returns the time by which the script must complete, or the
+// zero time if it has none; see Params.Deadline and Params.ScriptTimeout.
+func (ts *TestScript) deadline() time.Time {
+	deadline := ts.params.Deadline
+	earliest := func(t time.Time) {
+		if deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	if ts.params.ScriptTimeout > 0 {
+		earliest(time.Now().Add(ts.params.ScriptTimeout))
+	}
+	if dt, ok := ts.t.(interface{ Deadline() (time.Time, bool) }); ok {
+		if d, ok := dt.Deadline(); ok {
+			// Leave time to report the timeout and clean up before
+			// the test binary's own timeout fires.
+			grace := max(time.Until(d)/20, 100*time.Millisecond)
+			earliest(d.Add(-grace))
+		}
+	}
+	return deadline
+}
+
+// timedOut reports whether the script's deadline has passed and, if so,
+// fails the script, naming the line that was running.
+func (ts *TestScript) timedOut() bool {
+	if !errors.Is(ts.ctx.Err(), context.DeadlineExceeded) {
+		return false
+	}
+	ts.t.Fatalf("script:%d: timed out after %v running %q", ts.lineno, time.Since(ts.start).Round(time.Millisecond), ts.line)
+	return true
+}
+
+// writeSection writes the file section of step relative to dir and, with
+// Params.UpdateScripts, remembers where it was written.
+func (ts *TestScript) writeSection(dir string, step scriptStep) error {
+	if err := writeArchiveFile(dir, *step.file); err != nil {
+		return err
+	}
+	if ts.params.UpdateScripts {
+		ts.sections[filepath.Join(dir, filepath.FromSlash(step.file.Name))] = step
+	}
+	return nil
+}
+
+// updateSection records that the file section written to the file named
+// name should hold text instead, and reports whether it could: the file
+// must come from a section and still hold that section's contents.
+func (ts *TestScript) updateSection(name, text string) bool {
+	if !ts.params.UpdateScripts {
+		return false
+	}
+	step, ok := ts.sections[ts.MkAbs(name)]
+	if !ok {
+		return false
+	}
+	data, err := os.ReadFile(ts.MkAbs(name))
+	if err != nil || !bytes.Equal(data, step.file.Data) {
+		return false
+	}
+	if ts.updates == nil {
+		ts.updates = make(map[int]txtar.File)
+	}
+	ts.updates[step.index] = txtar.File{Name: step.file.Name, Data: []byte(text)}
+	ts.t.Logf("script:%d: updating section %s of %s", ts.lineno, step.file.Name, filepath.Base(ts.file))
+	return true
+}
+
+// updateScript rewrites the script file, whose original contents are
+// data, with the file sections recorded by updateSection.
+func (ts *TestScript) updateScript(data []byte) {
+	if len(ts.updates) == 0 {
+		return
+	}
+	ar := txtar.Parse(data)
+	for i, f := range ts.updates {
+		if i >= len(ar.Files) || ar.Files[i].Name != f.Name {
+			ts.t.Fatalf("updating %s: cannot find section %s", ts.file, f.Name)
+			return
+		}
+		ar.Files[i].Data = f.Data
+	}
+	if err := os.WriteFile(ts.file, txtar.Format(ar), 0666); err != nil {
+		ts.t.Fatalf("updating %s: %v", ts.file, err)
+	}
+}
+
+// writeArchiveFile writes the archive file f relative to dir, creating
+// parent directories as needed.
+func writeArchiveFile(dir string, f txtar.File) error {
+	name := filepath.Join(dir, filepath.FromSlash(f.Name))
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(name, f.Data, 0666)
+}
+
+// isCommand reports whether name is a builtin or custom command.
+func (ts *TestScript) isCommand(name string) bool {
+	return ts.builtin[name] != nil || ts.user[name] != nil
+}
+
 // parseLine parses and executes a single script line.
 func (ts *TestScript) parseLine(line string) {
-	ts.lineno++
 	line = strings.TrimSpace(line)
 	if line == "" || line[0] == '#' {
 		return
 	}
 
-	// Handle conditions like [short] or [!windows]
-	var cond string
-	if line[0] == '[' {
-		i := strings.Index(line, "]")
-		if i < 0 {
-			ts.t.Fatalf("script:%d: unterminated condition", ts.lineno)
-		}
-		cond = line[1:i]
-		line = strings.TrimSpace(line[i+1:])
-		if line == "" {
-			return
-		}
+	// Handle conditions like [short], [!windows] or [linux || darwin].
+	// The command runs only if all the conditions that precede it hold.
+	conds, line, err := parseConds(line)
+	if err != nil {
+		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+		return
 	}
-
-	if cond != "" {
-		ok, err := ts.condition(cond)
-		if err != nil {
-			ts.t.Fatalf("script:%d: %v", ts.lineno, err)
-		}
-		if !ok {
-			return
-		}
+	if line == "" {
+		return
+	}
+	ok, err := ts.evalConds(conds)
+	if err != nil {
+		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+		return
+	}
+	if !ok {
+		return
 	}
 
 	// Parse command line.
@@ -435,13 +876,21 @@ func (ts *TestScript) parseLine(line string) {
 		return
 	}
 
-	// Check for negation prefix.
+	// Check for negation ('!') or either-outcome ('?') prefix.
 	neg := false
-	if args[0] == "!" {
+	ts.mayFail = false
+	switch args[0] {
+	case "!":
 		neg = true
+	case "?":
+		ts.mayFail = true
+	}
+	if neg || ts.mayFail {
+		prefix := args[0]
 		args = args[1:]
 		if len(args) == 0 {
-			ts.t.Fatalf("script:%d: ! on line by itself", ts.lineno)
+			ts.t.Fatalf("script:%d: %s on line by itself", ts.lineno, prefix)
+			return
 		}
 	}
 
@@ -453,6 +902,10 @@ func (ts *TestScript) parseLine(line string) {
 // cmdExec executes a command with the given arguments.
 func (ts *TestScript) cmdExec(neg bool, args []string) {
 	cmd := args[0]
+	if ts.mayFail && cmd != "exec" && (ts.builtin[cmd] != nil || ts.user[cmd] != nil || ts.params.RequireExplicitExec) {
+		ts.t.Fatalf("script:%d: ? is only supported with exec", ts.lineno)
+		return
+	}
 	if ts.builtin[cmd] != nil {
 		ts.builtin[cmd](ts, neg, args)
 		return
@@ -472,6 +925,48 @@ func (ts *TestScript) cmdExec(neg bool, args []string) {
 
 // finalize cleans up after script execution.
 func (ts *TestScript) finalize() {
+	// stopBackground may fail the script, which stops the goroutine on
+	// a *testing.T, so clean up in deferred calls.
+	defer ts.removeWorkdir()
+	defer func() {
+		if ts.cancel != nil {
+			ts.cancel()
+		}
+	}()
+	defer ts.mergeCoverage()
+	ts.stopBackground()
+}
+
+// stopBackground kills any background commands that are still running at
+// the end of the script and reports those that exited unexpectedly.
+func (ts *TestScript) stopBackground() {
+	background := ts.background
+	ts.background = nil
+	var errs []error
+	for _, bg := range background {
+		select {
+		case err := <-bg.wait:
+			// The command finished on its own but was never waited for;
+			// its outcome still counts.
+			ts.logBackground(bg)
+			ts.logExitStatus(err)
+			if err := statusError(bg.neg, bg.mayFail, err); err != nil {
+				errs = append(errs, fmt.Errorf("background command %q: %w", bg.describe(), err))
+			}
+		default:
+			bg.cancel()
+			<-bg.wait
+			ts.Logf("[background] %s: killed at end of script", bg.describe())
+			ts.logBackground(bg)
+		}
+	}
+	if err := errors.Join(errs...); err != nil && !ts.t.Failed() {
+		ts.t.Fatalf("%v", err)
+	}
+}
+
+// removeWorkdir removes the work directory unless it should be retained.
+func (ts *TestScript) removeWorkdir() {
 	if !ts.params.TestWork {
 		removeAll(ts.workdir)
 	} else {
@@ -482,6 +977,8 @@ func (ts *TestScript) finalize() {
 // Built-in commands
 var builtinCmds = map[string]func(*TestScript, bool, []string){
 	"cd":     (*TestScript).cmdCD,
+	"cmp":    (*TestScript).cmdCmp,
+	"cmpenv": (*TestScript).cmdCmpenv,
 	"cp":     (*TestScript).cmdCp,
 	"env":    (*TestScript).cmdEnv,
 	"exec":   (*TestScript).cmdExecBuiltin,
@@ -491,6 +988,7 @@ var builtinCmds = map[string]func(*TestScript, bool, []string){
 	"rm":     (*TestScript).cmdRm,
 	"skip":   (*TestScript).cmdSkip,
 	"stderr": (*TestScript).cmdStderr,
+	"stdin":  (*TestScript).cmdStdin,
 	"stdout": (*TestScript).cmdStdout,
 	"stop":   (*TestScript).cmdStop,
 	"wait":   (*TestScript).cmdWait,
@@ -498,73 +996,114 @@ var builtinCmds = map[string]func(*TestScript, bool, []string){
 
 // Helper functions and remaining method implementations...
 
-// getLine returns the first line and the remainder of the input.
-func getLine(s string) (line, rest string) {
-	i := strings.Index(s, "\n")
-	if i < 0 {
-		return s, ""
-	}
-	return s[:i], s[i+1:]
-}
-
-// parse parses a command line into words, handling quotes and environment variables.
+// parse parses a command line into words.
+//
+// Words are separated by unquoted spaces or tabs, and an unquoted '#' at the
+// start of a word begins a comment that runs to the end of the line. Text
+// between single quotes is taken literally, including spaces; within quotes,
+// two consecutive single quotes stand for one quote character.
+//
+// Environment variables ($VAR or ${VAR}) are expanded only outside quotes,
+// after the line has been split, so a value containing spaces still forms
+// part of a single word. ${VAR@R} expands to the value quoted for use in a
+// regular expression.
 func (ts *TestScript) parse(line string) []string {
-	// Expand environment variables
-	expandedLine := ts.expandEnvVars(line)
-	return strings.Fields(expandedLine)
+	var (
+		args   []string
+		arg    strings.Builder // text of the current word so far
+		inWord bool            // whether a word has been started
+		start  = -1            // if >= 0, start of the current unquoted or quoted chunk
+		quoted bool            // inside a quoted chunk
+	)
+	for i := 0; ; i++ {
+		if !quoted && (i >= len(line) || line[i] == ' ' || line[i] == '\t' || line[i] == '\r' || (!inWord && line[i] == '#')) {
+			// End of a word.
+			if start >= 0 {
+				arg.WriteString(ts.expandEnvVars(line[start:i]))
+				start = -1
+			}
+			if inWord {
+				args = append(args, arg.String())
+				arg.Reset()
+				inWord = false
+			}
+			if i >= len(line) || line[i] == '#' {
+				return args
+			}
+			continue
+		}
+		if i >= len(line) {
+			ts.t.Fatalf("script:%d: unterminated quoted argument", ts.lineno)
+			return nil
+		}
+		inWord = true
+		if line[i] != '\'' {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		switch {
+		case !quoted:
+			// Start of a quoted chunk.
+			if start >= 0 {
+				arg.WriteString(ts.expandEnvVars(line[start:i]))
+			}
+			start = i + 1
+			quoted = true
+		case i+1 < len(line) && line[i+1] == '\'':
+			// 'foo''bar' means foo'bar.
+			arg.WriteString(line[start : i+1])
+			i++
+			start = i + 1
+		default:
+			// End of a quoted chunk.
+			arg.WriteString(line[start:i])
+			start = -1
+			quoted = false
+		}
+	}
 }
 
-// expandEnvVars expands environment variables in the form $VAR or ${VAR}
+// expandEnvVars expands environment variables in the form $VAR or ${VAR}.
+// The form ${VAR@R} expands to the value of VAR with all regular expression
+// metacharacters quoted.
 func (ts *TestScript) expandEnvVars(s string) string {
 	return os.Expand(s, func(key string) string {
-		if value, ok := ts.envMap[key]; ok {
-			return value
+		if name, ok := strings.CutSuffix(key, "@R"); ok {
+			return regexp.QuoteMeta(ts.lookupEnv(name))
 		}
-		return os.Getenv(key)
+		return ts.lookupEnv(key)
 	})
 }
 
-// condition evaluates whether a condition should be satisfied.
-func (ts *TestScript) condition(cond string) (bool, error) {
-	if ts.params.Condition != nil {
-		return ts.params.Condition(cond)
-	}
-
-	// Built-in conditions
-	switch cond {
-	case "short":
-		return testing.Short(), nil
-	case "windows":
-		return runtime.GOOS == "windows", nil
-	case "darwin":
-		return runtime.GOOS == "darwin", nil
-	case "linux":
-		return runtime.GOOS == "linux", nil
-	default:
-		if strings.HasPrefix(cond, "!") {
-			ok, err := ts.condition(cond[1:])
-			return !ok, err
-		}
-		return false, fmt.Errorf("unknown condition %q", cond)
+// lookupEnv returns the value of the named variable for expansion. The
+// host environment is never consulted; see Params.PassEnv.
+func (ts *TestScript) lookupEnv(key string) string {
+	value, ok := ts.env.lookup(key)
+	if !ok && ts.params.StrictEnv {
+		ts.t.Fatalf("script:%d: environment variable %s is not set", ts.lineno, key)
 	}
+	return value
 }
 
-// mkabs returns an absolute path for the given file within the test's work directory.
-func (ts *TestScript) mkabs(file string) string {
+// MkAbs returns an absolute path for the given file, interpreting relative
+// paths relative to the script's current directory, as changed by cd.
+func (ts *TestScript) MkAbs(file string) string {
 	if filepath.IsAbs(file) {
 		return file
 	}
-	return filepath.Join(ts.workdir, file)
+	return filepath.Join(ts.cd, file)
 }
 
-// refreshEnvMap updates the environment variable map.
-func (ts *TestScript) refreshEnvMap() {
-	ts.envMap = make(map[string]string)
-	for _, kv := range ts.env {
-		if i := strings.Index(kv, "="); i >= 0 {
-			ts.envMap[kv[:i]] = kv[i+1:]
-		}
+// Context returns a context that is canceled when the script's deadline
+// passes or the script ends. Custom commands that may block should honor
+// it; programs started by exec are interrupted when it is done.
+func (ts *TestScript) Context() context.Context {
+	if ts.ctx == nil {
+		return context.Background()
 	}
+	return ts.ctx
 }
 
 // Logf formats and logs a message.
@@ -587,9 +1126,10 @@ func (ts *TestScript) Fatal(args ...any) {
 	ts.t.Fatal(append([]any{fmt.Sprintf("script:%d:", ts.lineno)}, args...)...)
 }
 
-// ReadFile reads the named file and returns its contents.
+// ReadFile reads the named file, relative to the current directory, and
+// returns its contents.
 func (ts *TestScript) ReadFile(filename string) string {
-	filename = ts.mkabs(filename)
+	filename = ts.MkAbs(filename)
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		ts.t.Fatal(err)
@@ -604,7 +1144,8 @@ func (ts *TestScript) Chdir(dir string) {
 
 // Getenv retrieves the value of the environment variable named by the key.
 func (ts *TestScript) Getenv(key string) string {
-	return ts.envMap[key]
+	value, _ := ts.env.lookup(key)
+	return value
 }
 
 // Setenv sets the value of the environment variable named by the key.
@@ -612,14 +1153,22 @@ func (ts *TestScript) Setenv(key, value string) {
 	ts.cmdEnv(false, []string{"env", key + "=" + value})
 }
 
-// Exec runs the named program with the given arguments.
+// SetStdin sets the standard input of the next program run by the exec
+// builtin or Exec, as the stdin builtin does. It applies to that program
+// only; later programs read from an empty input again.
+func (ts *TestScript) SetStdin(r io.Reader) {
+	ts.stdin = r
+}
+
+// Exec runs the named program with the given arguments. The program's
+// standard output and error are recorded as the script's stdout and stderr,
+// as with the exec builtin. A non-nil error is returned if the program could
+// not be started or exited unsuccessfully.
 func (ts *TestScript) Exec(name string, args ...string) error {
-	cmdArgs := append([]string{"exec", name}, args...)
-	ts.cmdExecBuiltin(false, cmdArgs)
-	if ts.t.Failed() {
-		return errors.New("exec failed")
-	}
-	return nil
+	var err error
+	ts.stdout, ts.stderr, err = ts.exec(name, args...)
+	ts.logOutput()
+	return err
 }
 
 // Built-in command implementations
@@ -627,12 +1176,14 @@ func (ts *TestScript) Exec(name string, args ...string) error {
 func (ts *TestScript) cmdCD(neg bool, args []string) {
 	if len(args) != 2 {
 		ts.t.Fatalf("script:%d: usage: cd dir", ts.lineno)
+		return
 	}
 	dir := args[1]
 	if !filepath.IsAbs(dir) {
 		if ts.cd == "" {
 			if ts.workdir == "" {
 				ts.t.Fatalf("script:%d: workdir not initialized", ts.lineno)
+				return
 			}
 			ts.cd = ts.workdir
 		}
@@ -641,58 +1192,296 @@ func (ts *TestScript) cmdCD(neg bool, args []string) {
 	info, err := os.Stat(dir)
 	if os.IsNotExist(err) {
 		ts.t.Fatalf("script:%d: directory %s does not exist", ts.lineno, dir)
+		return
 	}
 	if err != nil {
 		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+		return
 	}
 	if !info.IsDir() {
 		ts.t.Fatalf("script:%d: %s is not a directory", ts.lineno, dir)
+		return
 	}
 	ts.cd = dir
 }
 
+// cmdCmp compares two files, either of which may be stdout or stderr to
+// stand for the output of the last command.
+func (ts *TestScript) cmdCmp(neg bool, args []string) {
+	ts.compare(neg, args, false)
+}
+
+// cmdCmpenv is like cmdCmp, but expands environment variables in the
+// second file before comparing.
+func (ts *TestScript) cmdCmpenv(neg bool, args []string) {
+	ts.compare(neg, args, true)
+}
+
+// compare implements cmp and cmpenv. On a mismatch, it fails with a
+// unified diff turning the first file into the second. With -trim,
+// trailing spaces, tabs and carriage returns are ignored on every line,
+// so that CRLF and LF line endings compare equal.
+func (ts *TestScript) compare(neg bool, args []string, env bool) {
+	usage := fmt.Sprintf("usage: %s [-trim] file1 file2", args[0])
+	args = args[1:]
+	trim := false
+	if len(args) > 0 && args[0] == "-trim" {
+		trim = true
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	name1, name2 := args[0], args[1]
+	text1, text2 := ts.readText(name1), ts.readText(name2)
+	if ts.t.Failed() {
+		return
+	}
+	if env {
+		text2 = ts.expandEnvVars(text2)
+	}
+	output := text1
+	if trim {
+		text1, text2 = trimLines(text1), trimLines(text2)
+	}
+	if neg {
+		if text1 == text2 {
+			ts.t.Fatalf("script:%d: %s and %s do not differ", ts.lineno, name1, name2)
+		}
+		return
+	}
+	if text1 == text2 {
+		return
+	}
+	if !env && (name1 == "stdout" || name1 == "stderr") && ts.updateSection(name2, output) {
+		return
+	}
+	ts.t.Fatalf("script:%d: %s and %s differ:\n%s", ts.lineno, name1, name2, truncateOutput(unifiedDiff(name1, text1, name2, text2)))
+}
+
+// trimLines removes trailing spaces, tabs and carriage returns from each
+// line of text.
+func trimLines(text string) string {
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		line, nl := strings.CutSuffix(line, "\n")
+		line = strings.TrimRight(line, " \t\r")
+		if nl {
+			line += "\n"
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "")
+}
+
+// readText returns the contents of the named file or, for stdout and
+// stderr, the output of the last command.
+func (ts *TestScript) readText(name string) string {
+	switch name {
+	case "stdout":
+		return ts.stdout
+	case "stderr":
+		return ts.stderr
+	}
+	data, err := os.ReadFile(ts.MkAbs(name))
+	if err != nil {
+		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+	}
+	return string(data)
+}
+
 func (ts *TestScript) cmdCp(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: unsupported: ! cp", ts.lineno)
+		return
+	}
 	if len(args) < 3 {
 		ts.t.Fatalf("script:%d: usage: cp src... dst", ts.lineno)
+		return
+	}
+	dst := ts.MkAbs(args[len(args)-1])
+	info, err := os.Stat(dst)
+	dstDir := err == nil && info.IsDir()
+	if len(args) > 3 && !dstDir {
+		ts.t.Fatalf("script:%d: cp: destination %s is not a directory", ts.lineno, dst)
+		return
+	}
+	for _, arg := range args[1 : len(args)-1] {
+		var err error
+		switch arg {
+		case "stdout", "stderr":
+			// The captured output of the last command is copied as if
+			// it were a file of that name.
+			data := ts.stdout
+			if arg == "stderr" {
+				data = ts.stderr
+			}
+			targ := dst
+			if dstDir {
+				targ = filepath.Join(dst, arg)
+			}
+			err = writeFileMode(targ, []byte(data), 0666)
+		default:
+			src := ts.MkAbs(arg)
+			targ := dst
+			if dstDir {
+				targ = filepath.Join(dst, filepath.Base(src))
+			}
+			err = copyPath(targ, src)
+		}
+		if err != nil {
+			ts.t.Fatalf("script:%d: cp: %v", ts.lineno, err)
+			return
+		}
 	}
-	// Implementation would copy files
-	ts.t.Fatalf("script:%d: cp command not fully implemented", ts.lineno)
 }
 
+// cmdEnv sets, unsets and prints environment variables. With no
+// arguments, it prints all of them as key=value lines. Otherwise, each
+// argument of the form key=value sets a variable, -u key unsets one, and
+// a bare key prints that variable's value on a line of its own, or an
+// empty line if it is not set. Printed values become the stdout that
+// later commands such as stdout and cmp check.
 func (ts *TestScript) cmdEnv(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: unsupported: ! env", ts.lineno)
+		return
+	}
 	if len(args) == 1 {
-		// Print all environment variables
-		for _, env := range ts.env {
-			ts.t.Log(env)
+		ts.stdout, ts.stderr = "", ""
+		for _, kv := range ts.env {
+			ts.stdout += kv + "\n"
 		}
+		ts.logOutput()
 		return
 	}
-	if len(args) != 2 {
-		ts.t.Fatalf("script:%d: usage: env [key=value]", ts.lineno)
+	var out strings.Builder
+	printed := false
+	for args = args[1:]; len(args) > 0; args = args[1:] {
+		switch arg := args[0]; {
+		case arg == "-u":
+			if len(args) < 2 {
+				ts.t.Fatalf("script:%d: usage: env [key=value | -u key | key]...", ts.lineno)
+				return
+			}
+			ts.env.unset(args[1])
+			args = args[1:]
+		case strings.Contains(arg, "="):
+			key, value, _ := strings.Cut(arg, "=")
+			if key == "" {
+				ts.t.Fatalf("script:%d: env: empty variable name in %q", ts.lineno, arg)
+				return
+			}
+			ts.env.set(key, value)
+		default:
+			value, _ := ts.env.lookup(arg)
+			out.WriteString(value + "\n")
+			printed = true
+		}
 	}
-	kv := args[1]
-	if i := strings.Index(kv, "="); i >= 0 {
-		key, value := kv[:i], kv[i+1:]
-		ts.env = append(ts.env, key+"="+value)
-		ts.envMap[key] = value
-	} else {
-		ts.t.Fatalf("script:%d: env: no '=' in argument", ts.lineno)
+	if printed {
+		ts.stdout, ts.stderr = out.String(), ""
+		ts.logOutput()
 	}
 }
 
 func (ts *TestScript) cmdExecBuiltin(neg bool, args []string) {
+	bgName, background := backgroundName(args[len(args)-1])
+	if background {
+		args = args[:len(args)-1]
+	}
 	if len(args) < 2 {
-		ts.t.Fatalf("script:%d: usage: exec program [args...]", ts.lineno)
+		ts.t.Fatalf("script:%d: usage: exec program [args...] [&|&name&]", ts.lineno)
+		return
+	}
+	if background {
+		ts.startBackground(neg, bgName, args[1:])
+		return
+	}
+	var err error
+	ts.stdout, ts.stderr, err = ts.exec(args[1], args[2:]...)
+	ts.logOutput()
+	ts.logExitStatus(err)
+	if ts.timedOut() {
+		return
+	}
+	if err := statusError(neg, ts.mayFail, err); err != nil {
+		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
 	}
-	// Implementation would execute external programs
-	ts.t.Fatalf("script:%d: exec command not fully implemented", ts.lineno)
+}
+
+// startBackground starts the given command without waiting for it to
+// complete. Its output and exit status are collected by a later 'wait',
+// or when the script ends.
+func (ts *TestScript) startBackground(neg bool, name string, args []string) {
+	if name != "" {
+		for _, bg := range ts.background {
+			if bg.name == name {
+				ts.t.Fatalf("script:%d: duplicate background command name %q", ts.lineno, name)
+				return
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(ts.Context())
+	cmd, err := ts.buildExecCmd(ctx, args[0], args[1:]...)
+	if err != nil {
+		cancel()
+		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+		return
+	}
+	bg := &backgroundCmd{
+		name:    name,
+		args:    args,
+		cancel:  cancel,
+		neg:     neg,
+		mayFail: ts.mayFail,
+	}
+	cmd.Stdout = &bg.stdout
+	cmd.Stderr = &bg.stderr
+	if err := cmd.Start(); err != nil {
+		cancel()
+		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+		return
+	}
+	wait := make(chan error, 1)
+	go func() {
+		wait <- cmd.Wait()
+		cancel()
+	}()
+	bg.wait = wait
+	ts.background = append(ts.background, bg)
+}
+
+// statusError returns a non-nil error if the outcome of a command does not
+// match what the script expects: success by default, failure when negated
+// with '!', and either outcome when prefixed with '?'. The exit status of
+// a failed command is logged.
+func statusError(neg, mayFail bool, err error) error {
+	if err == nil {
+		if neg && !mayFail {
+			return errors.New("unexpected command success")
+		}
+		return nil
+	}
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		// The command could not be started at all; this is never
+		// an expected outcome.
+		return err
+	}
+	if !neg && !mayFail {
+		return fmt.Errorf("unexpected command failure: %s", exitStatus(ee))
+	}
+	return nil
 }
 
 func (ts *TestScript) cmdExists(neg bool, args []string) {
 	if len(args) != 2 {
 		ts.t.Fatalf("script:%d: usage: exists file", ts.lineno)
+		return
 	}
-	file := ts.mkabs(args[1])
+	file := ts.MkAbs(args[1])
 	_, err := os.Stat(file)
 	exists := err == nil
 	if neg {
@@ -708,21 +1497,19 @@ func (ts *TestScript) cmdExists(neg bool, args []string) {
 }
 
 func (ts *TestScript) cmdGrep(neg bool, args []string) {
-	if len(args) != 3 {
-		ts.t.Fatalf("script:%d: usage: grep pattern file", ts.lineno)
-	}
-	// Implementation would search for patterns in files
-	ts.t.Fatalf("script:%d: grep command not fully implemented", ts.lineno)
+	ts.scriptMatch(neg, args, "", "")
 }
 
 func (ts *TestScript) cmdMkdir(neg bool, args []string) {
 	if len(args) < 2 {
 		ts.t.Fatalf("script:%d: usage: mkdir dir...", ts.lineno)
+		return
 	}
 	for _, arg := range args[1:] {
-		dir := ts.mkabs(arg)
+		dir := ts.MkAbs(arg)
 		if err := os.MkdirAll(dir, 0777); err != nil {
 			ts.t.Fatalf("script:%d: mkdir %s: %v", ts.lineno, dir, err)
+			return
 		}
 	}
 }
@@ -730,9 +1517,10 @@ func (ts *TestScript) cmdMkdir(neg bool, args []string) {
 func (ts *TestScript) cmdRm(neg bool, args []string) {
 	if len(args) < 2 {
 		ts.t.Fatalf("script:%d: usage: rm file...", ts.lineno)
+		return
 	}
 	for _, arg := range args[1:] {
-		file := ts.mkabs(arg)
+		file := ts.MkAbs(arg)
 		removeAll(file)
 	}
 }
@@ -743,22 +1531,124 @@ func (ts *TestScript) cmdSkip(neg bool, args []string) {
 	} else {
 		ts.t.Skip()
 	}
+	// Skip returns if t is a TestingT without subtests.
+	ts.stopped = true
 }
 
 func (ts *TestScript) cmdStderr(neg bool, args []string) {
+	ts.scriptMatch(neg, args, ts.stderr, "stderr")
+}
+
+// cmdStdin sets the standard input of the next exec to the contents of a
+// file, or the output of the last command for stdout and stderr. With -s,
+// the input is instead the remaining arguments separated by spaces and
+// followed by a newline, as echo would print them.
+func (ts *TestScript) cmdStdin(neg bool, args []string) {
+	if neg {
+		ts.t.Fatalf("script:%d: unsupported: ! stdin", ts.lineno)
+		return
+	}
+	if len(args) >= 2 && args[1] == "-s" {
+		ts.SetStdin(strings.NewReader(strings.Join(args[2:], " ") + "\n"))
+		return
+	}
 	if len(args) != 2 {
-		ts.t.Fatalf("script:%d: usage: stderr text", ts.lineno)
+		ts.t.Fatalf("script:%d: usage: stdin file | stdin -s text...", ts.lineno)
+		return
 	}
-	// Implementation would check stderr content
-	ts.t.Fatalf("script:%d: stderr command not fully implemented", ts.lineno)
+	text := ts.readText(args[1])
+	if ts.t.Failed() {
+		return
+	}
+	ts.SetStdin(strings.NewReader(text))
 }
 
 func (ts *TestScript) cmdStdout(neg bool, args []string) {
-	if len(args) != 2 {
-		ts.t.Fatalf("script:%d: usage: stdout text", ts.lineno)
+	ts.scriptMatch(neg, args, ts.stdout, "stdout")
+}
+
+// scriptMatch implements the stdout, stderr and grep commands: it checks
+// that text, named name in messages, matches the regular expression given
+// in args. For grep, the text is instead read from the file named after
+// the pattern, relative to the current directory.
+//
+// The pattern is compiled in multi-line mode, so ^ and $ match at line
+// boundaries. With -multiline, . also matches newlines, so that a pattern
+// such as 'begin.*end' can span several lines.
+func (ts *TestScript) scriptMatch(neg bool, args []string, text, name string) {
+	isGrep := args[0] == "grep"
+	usage := fmt.Sprintf("usage: %s [-count=N] [-q] [-multiline] pattern", args[0])
+	want := 1
+	if isGrep {
+		usage += " file"
+		want = 2
+	}
+	count := -1
+	quiet := false
+	flags := "(?m)"
+	args = args[1:]
+	for len(args) > 0 {
+		if v, ok := strings.CutPrefix(args[0], "-count="); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				ts.t.Fatalf("script:%d: bad -count=%s: must be a non-negative integer", ts.lineno, v)
+				return
+			}
+			count = n
+		} else if args[0] == "-q" {
+			quiet = true
+		} else if args[0] == "-multiline" {
+			flags = "(?ms)"
+		} else {
+			break
+		}
+		args = args[1:]
+	}
+	if len(args) != want {
+		ts.t.Fatalf("script:%d: %s", ts.lineno, usage)
+		return
+	}
+	if neg && count >= 0 {
+		ts.t.Fatalf("script:%d: cannot use -count= with negated match", ts.lineno)
+		return
+	}
+	pattern := args[0]
+	re, err := regexp.Compile(flags + pattern)
+	if err != nil {
+		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+		return
+	}
+	if isGrep {
+		name = args[1]
+		data, err := os.ReadFile(ts.MkAbs(name))
+		if err != nil {
+			ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+			return
+		}
+		text = string(data)
+	}
+
+	// show returns the text to include in a failure message.
+	show := func() string {
+		if quiet {
+			return ""
+		}
+		return fmt.Sprintf("\n[%s]\n%s", name, truncateOutput(text))
+	}
+	switch {
+	case neg:
+		if loc := re.FindStringIndex(text); loc != nil {
+			ts.t.Fatalf("script:%d: unexpected match for %#q found in %s: %q%s", ts.lineno, pattern, name, text[loc[0]:loc[1]], show())
+		}
+	case count >= 0:
+		if n := len(re.FindAllStringIndex(text, -1)); n != count {
+			ts.t.Fatalf("script:%d: have %d matches for %#q in %s, want %d%s", ts.lineno, n, pattern, name, count, show())
+		}
+	default:
+		if !re.MatchString(text) {
+			ts.t.Fatalf("script:%d: no match for %#q found in %s%s", ts.lineno, pattern, name, show())
+		}
 	}
-	// Implementation would check stdout content
-	ts.t.Fatalf("script:%d: stdout command not fully implemented", ts.lineno)
 }
 
 func (ts *TestScript) cmdStop(neg bool, args []string) {
@@ -766,12 +1656,289 @@ func (ts *TestScript) cmdStop(neg bool, args []string) {
 }
 
 func (ts *TestScript) cmdWait(neg bool, args []string) {
-	// Implementation would wait for background commands
-	ts.t.Fatalf("script:%d: wait command not fully implemented", ts.lineno)
+	if neg {
+		ts.t.Fatalf("script:%d: unsupported: ! wait", ts.lineno)
+		return
+	}
+	if len(args) > 2 {
+		ts.t.Fatalf("script:%d: usage: wait [name]", ts.lineno)
+		return
+	}
+	var waiting, remaining []*backgroundCmd
+	if len(args) == 2 {
+		for _, bg := range ts.background {
+			if bg.name == args[1] {
+				waiting = append(waiting, bg)
+			} else {
+				remaining = append(remaining, bg)
+			}
+		}
+		if len(waiting) == 0 {
+			ts.t.Fatalf("script:%d: no background command named %q", ts.lineno, args[1])
+			return
+		}
+	} else {
+		waiting = ts.background
+	}
+	ts.background = remaining
+
+	// The output of all waited-for commands is merged, in the order
+	// they were started, so that it can be checked like that of a
+	// foreground command.
+	var stdout, stderr strings.Builder
+	var errs []error
+	for _, bg := range waiting {
+		err := <-bg.wait
+		ts.logBackground(bg)
+		ts.logExitStatus(err)
+		stdout.WriteString(bg.stdout.String())
+		stderr.WriteString(bg.stderr.String())
+		if err := statusError(bg.neg, bg.mayFail, err); err != nil {
+			errs = append(errs, fmt.Errorf("background command %q: %w", bg.describe(), err))
+		}
+	}
+	ts.stdout = stdout.String()
+	ts.stderr = stderr.String()
+	if ts.timedOut() {
+		return
+	}
+	if err := errors.Join(errs...); err != nil {
+		ts.t.Fatalf("script:%d: %v", ts.lineno, err)
+	}
 }
 
 // Utility functions
 
+// exec runs the named program with the given arguments in the current
+// directory and with the script's environment, and returns its standard
+// output and error.
+func (ts *TestScript) exec(name string, args ...string) (stdout, stderr string, err error) {
+	cmd, err := ts.buildExecCmd(ts.Context(), name, args...)
+	if err != nil {
+		return "", "", err
+	}
+	var stdoutBuf, stderrBuf strings.Builder
+	cmd.Stdout = &stdoutBuf
+	cmd.Stderr = &stderrBuf
+	err = cmd.Run()
+	return stdoutBuf.String(), stderrBuf.String(), err
+}
+
+// buildExecCmd returns a command that runs the named program in the
+// script's current directory and environment.
+func (ts *TestScript) buildExecCmd(ctx context.Context, name string, args ...string) (*exec.Cmd, error) {
+	// The input applies to this command even if it can't start.
+	stdin := ts.stdin
+	ts.stdin = nil
+	path, err := ts.lookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Args[0] = name
+	cmd.Dir = ts.cd
+	cmd.Env = ts.env.with("PWD", ts.cd)
+	cmd.Stdin = stdin
+	cmd.Cancel = func() error {
+		if errors.Is(ts.Context().Err(), context.DeadlineExceeded) {
+			// Give a hung program the chance to show where it is stuck;
+			// it is killed after WaitDelay if it doesn't exit.
+			return cmd.Process.Signal(quitSignal())
+		}
+		return cmd.Process.Kill()
+	}
+	// Don't let a grandchild that inherited the output pipes keep us
+	// waiting once the command itself has exited or been killed.
+	cmd.WaitDelay = execWaitDelay
+	return cmd, nil
+}
+
+// lookPath searches for an executable named file in the directories named
+// by the script's PATH environment variable, rather than the host's.
+// Names containing a path separator are returned unchanged and resolved
+// by the operating system relative to the current directory.
+func (ts *TestScript) lookPath(file string) (string, error) {
+	if strings.ContainsAny(file, `/\`) {
+		return file, nil
+	}
+	exts := []string{""}
+	if runtime.GOOS == "windows" {
+		pathext := ts.Getenv("PATHEXT")
+		if pathext == "" {
+			pathext = ".com;.exe;.bat;.cmd"
+		}
+		exts = strings.Split(strings.ToLower(pathext), ";")
+		// As with exec.LookPath, a name that already has one of the
+		// extensions, such as prog$exe, is tried as given first.
+		if ext := strings.ToLower(filepath.Ext(file)); ext != "" && slices.Contains(exts, ext) {
+			exts = append([]string{""}, exts...)
+		}
+	}
+	for _, dir := range filepath.SplitList(ts.Getenv("PATH")) {
+		if dir == "" {
+			continue
+		}
+		for _, ext := range exts {
+			path := filepath.Join(dir, file+ext)
+			info, err := os.Stat(path)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			if runtime.GOOS == "windows" || info.Mode()&0111 != 0 {
+				return path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s: executable file not found in $PATH", file)
+}
+
+// logOutput logs the output captured by the last command.
+func (ts *TestScript) logOutput() {
+	if ts.stdout != "" {
+		ts.Logf("[stdout]\n%s", ts.stdout)
+	}
+	if ts.stderr != "" {
+		ts.Logf("[stderr]\n%s", ts.stderr)
+	}
+}
+
+// logExitStatus logs the exit status of a command that ran unsuccessfully.
+func (ts *TestScript) logExitStatus(err error) {
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		ts.Logf("[%s]", exitStatus(ee))
+	}
+}
+
+// logBackground logs the command line and output of a background command.
+func (ts *TestScript) logBackground(bg *backgroundCmd) {
+	ts.Logf("[background] %s", bg.describe())
+	if s := bg.stdout.String(); s != "" {
+		ts.Logf("[stdout]\n%s", s)
+	}
+	if s := bg.stderr.String(); s != "" {
+		ts.Logf("[stderr]\n%s", s)
+	}
+}
+
+// describe returns the command line of bg, for use in messages.
+func (bg *backgroundCmd) describe() string {
+	desc := strings.Join(bg.args, " ")
+	if bg.name != "" {
+		desc += " &" + bg.name + "&"
+	}
+	return desc
+}
+
+// backgroundName reports whether arg requests background execution: either
+// a bare '&', or '&name&' to name the command for a later 'wait name'.
+func backgroundName(arg string) (name string, ok bool) {
+	if arg == "&" {
+		return "", true
+	}
+	if len(arg) > 2 && strings.HasPrefix(arg, "&") && strings.HasSuffix(arg, "&") {
+		return arg[1 : len(arg)-1], true
+	}
+	return "", false
+}
+
+// maxOutputLines is the number of lines of output shown in failure
+// messages; longer output keeps only its beginning and end.
+const maxOutputLines = 40
+
+// truncateOutput shortens long output for display in failure messages.
+func truncateOutput(s string) string {
+	if s == "" {
+		return "(empty)"
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= maxOutputLines {
+		return s
+	}
+	half := maxOutputLines / 2
+	omitted := len(lines) - 2*half
+	return strings.Join(lines[:half], "") +
+		fmt.Sprintf("[... %d lines omitted ...]\n", omitted) +
+		strings.Join(lines[len(lines)-half:], "")
+}
+
+// exitStatus describes how a process exited: its exit code, or the signal
+// that terminated it.
+func exitStatus(ee *exec.ExitError) string {
+	if code := ee.ExitCode(); code >= 0 {
+		return fmt.Sprintf("exit code %d", code)
+	}
+	// ProcessState describes termination by signal, e.g. "signal: killed".
+	return ee.ProcessState.String()
+}
+
+// copyPath copies the file or directory tree at src to dst, preserving
+// permission bits.
+func copyPath(dst, src string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		return writeFileMode(dst, data, info.Mode().Perm())
+	}
+	// Directory permissions are applied once the whole tree has been
+	// copied, so that read-only directories can still be populated.
+	type dirMode struct {
+		path string
+		perm os.FileMode
+	}
+	var dirs []dirMode
+	err = filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		targ := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, dirMode{targ, info.Mode().Perm()})
+			return os.MkdirAll(targ, 0777)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return writeFileMode(targ, data, info.Mode().Perm())
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileMode writes data to the named file and sets its permission bits
+// to perm, even if the file already existed.
+func writeFileMode(name string, data []byte, perm os.FileMode) error {
+	if err := os.WriteFile(name, data, perm); err != nil {
+		return err
+	}
+	return os.Chmod(name, perm)
+}
+
 func removeAll(path string) error {
 	return os.RemoveAll(path)
 }
@@ -787,6 +1954,18 @@ func homeEnvName() string {
 	}
 }
 
+// systemEnvNames returns the names of the host environment variables
+// that programs need to run at all, such as those Windows uses to find
+// system libraries and executables. Scripts always get them.
+func systemEnvNames() []string {
+	switch runtime.GOOS {
+	case "windows":
+		return []string{"SYSTEMROOT", "WINDIR", "ComSpec", "PATHEXT"}
+	default:
+		return nil
+	}
+}
+
 func tempEnvName() string {
 	switch runtime.GOOS {
 	case "windows":
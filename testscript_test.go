@@ -1,9 +1,41 @@
 package testscript
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	Main(m, map[string]func() int{
+		"tsar-echo": func() int {
+			fmt.Println(strings.Join(os.Args[1:], " "))
+			return 0
+		},
+		"tsar-cat": func() int {
+			if _, err := io.Copy(os.Stdout, os.Stdin); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			return 0
+		},
+		"tsar-exit": func() int {
+			fmt.Fprintln(os.Stderr, "exiting")
+			code, _ := strconv.Atoi(os.Args[1])
+			return code
+		},
+	})
+}
+
 func TestTsarBasic(t *testing.T) {
 	Run(t, Params{
 		Dir: "examples/testdata",
@@ -20,3 +52,967 @@ func TestTsarWithCommands(t *testing.T) {
 		},
 	})
 }
+
+func TestScripts(t *testing.T) {
+	Run(t, Params{
+		Dir: "testdata",
+	})
+}
+
+func TestExecFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"ExitCode", "exec sh exit.sh", "unexpected command failure: exit code 3"},
+		{"Signal", "exec sh kill.sh", "unexpected command failure: signal: killed"},
+		{"Success", "! exec true", "unexpected command success"},
+		{"NotFound", "exec no-such-program", "executable file not found"},
+		{"MayFailBuiltin", "? exists foo", "? is only supported with exec"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := tt.script + "\n-- exit.sh --\nexit 3\n-- kill.sh --\nkill -KILL $$\n"
+			rt := runScript(t, Params{}, script)
+			if !rt.failed {
+				t.Fatalf("script succeeded unexpectedly")
+			}
+			if !strings.Contains(rt.fatal, tt.want) {
+				t.Errorf("failure %q does not contain %q", rt.fatal, tt.want)
+			}
+		})
+	}
+}
+
+// runScript runs the given script text with a recordingT and returns it.
+func runScript(t *testing.T, p Params, script string) *recordingT {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "script.tsar")
+	if err := os.WriteFile(file, []byte(script), 0666); err != nil {
+		t.Fatal(err)
+	}
+	rt := &recordingT{}
+	RunFiles(rt, p, file)
+	return rt
+}
+
+// recordingT is a TestingT that records failures instead of stopping
+// the calling goroutine.
+type recordingT struct {
+	failed bool
+	fatal  string // first failure message
+	logs   strings.Builder
+}
+
+func (t *recordingT) Skip(args ...any) {}
+
+func (t *recordingT) Fatal(args ...any) {
+	t.fail(fmt.Sprintln(args...))
+}
+
+func (t *recordingT) Fatalf(format string, args ...any) {
+	t.fail(fmt.Sprintf(format, args...))
+}
+
+func (t *recordingT) fail(msg string) {
+	if !t.failed {
+		t.fatal = strings.TrimSpace(msg)
+	}
+	t.failed = true
+}
+
+func (t *recordingT) Log(args ...any) {
+	fmt.Fprintln(&t.logs, args...)
+}
+
+func (t *recordingT) Logf(format string, args ...any) {
+	fmt.Fprintf(&t.logs, format+"\n", args...)
+}
+
+func (t *recordingT) Failed() bool { return t.failed }
+
+func (t *recordingT) Helper() {}
+
+func TestWaitOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	var stdout, stderr string
+	rt := runScript(t, Params{
+		Commands: map[string]func(*TestScript, bool, []string){
+			"record": func(ts *TestScript, neg bool, args []string) {
+				stdout, stderr = ts.stdout, ts.stderr
+			},
+		},
+	}, `
+exec sh out.sh first &
+exec sh out.sh second &
+wait
+record
+-- out.sh --
+echo "$1 out"
+echo "$1 err" >&2
+`)
+	if rt.failed {
+		t.Fatalf("script failed: %s", rt.fatal)
+	}
+	if want := "first out\nsecond out\n"; stdout != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+	if want := "first err\nsecond err\n"; stderr != want {
+		t.Errorf("stderr = %q, want %q", stderr, want)
+	}
+}
+
+func TestBackgroundFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"Wait", "exec false &\nwait", `background command "false": unexpected command failure: exit code 1`},
+		{"WaitNamed", "exec true &a&\n! exec true &b&\nwait b", `background command "true &b&": unexpected command success`},
+		{"NotWaited", "exec false &", `background command "false": unexpected command failure: exit code 1`},
+		{"UnknownName", "wait nope", `no background command named "nope"`},
+		{"DuplicateName", "exec true &a&\nexec true &a&", `duplicate background command name "a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := tt.script
+			if tt.name == "NotWaited" {
+				// Give the command time to exit before the script ends.
+				script += "\nexec sleep 0.2"
+			}
+			rt := runScript(t, Params{}, script)
+			if !rt.failed {
+				t.Fatalf("script succeeded unexpectedly")
+			}
+			if !strings.Contains(rt.fatal, tt.want) {
+				t.Errorf("failure %q does not contain %q", rt.fatal, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"NoMatch", "stdout ^goodbye", "no match for `^goodbye` found in stdout\n[stdout]\nhello\nhello"},
+		{"Quiet", "stdout -q ^goodbye", "no match for `^goodbye` found in stdout"},
+		{"Unexpected", "! stdout ell", "unexpected match for `ell` found in stdout: \"ell\""},
+		{"Count", "stdout -count=1 hello", "have 2 matches for `hello` in stdout, want 1"},
+		{"NegatedCount", "! stdout -count=1 hello", "cannot use -count= with negated match"},
+		{"BadCount", "stdout -count=x hello", "bad -count=x"},
+		{"Stderr", "stderr hello", "no match for `hello` found in stderr\n[stderr]\n(empty)"},
+		{"BadPattern", "stdout (", "missing closing )"},
+		{"Usage", "stdout", "usage: stdout [-count=N] [-q] [-multiline] pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := runScript(t, Params{}, "exec sh hello.sh\n"+tt.script+"\n-- hello.sh --\necho hello\necho hello\n")
+			if !rt.failed {
+				t.Fatalf("script succeeded unexpectedly")
+			}
+			if !strings.Contains(rt.fatal, tt.want) {
+				t.Errorf("failure %q does not contain %q", rt.fatal, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	var b strings.Builder
+	for i := range 100 {
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	got := truncateOutput(b.String())
+	if !strings.HasPrefix(got, "line 0\n") || !strings.HasSuffix(got, "line 99\n") {
+		t.Errorf("truncated output lost its beginning or end:\n%s", got)
+	}
+	if !strings.Contains(got, "[... 60 lines omitted ...]\nline 80\n") {
+		t.Errorf("truncated output missing omission marker:\n%s", got)
+	}
+	if s := "short\n"; truncateOutput(s) != s {
+		t.Errorf("short output was modified")
+	}
+}
+
+func TestGrepFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"NoMatch", "grep ^goodbye hello.txt", "no match for `^goodbye` found in hello.txt\n[hello.txt]\nhello world"},
+		{"Quiet", "grep -q ^goodbye hello.txt", "no match for `^goodbye` found in hello.txt"},
+		{"Count", "grep -count=2 hello hello.txt", "have 1 matches for `hello` in hello.txt, want 2"},
+		{"Missing", "grep hello missing.txt", "missing.txt"},
+		{"Usage", "grep hello", "usage: grep [-count=N] [-q] [-multiline] pattern file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := runScript(t, Params{}, tt.script+"\n-- hello.txt --\nhello world\n")
+			if !rt.failed {
+				t.Fatalf("script succeeded unexpectedly")
+			}
+			if !strings.Contains(rt.fatal, tt.want) {
+				t.Errorf("failure %q does not contain %q", rt.fatal, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyPathPreservesMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not preserved on Windows")
+	}
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(src, "ro"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "ro", "data"), []byte("data"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "ro"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "dst")
+	t.Cleanup(func() {
+		// Allow the temporary directories to be removed.
+		os.Chmod(filepath.Join(src, "ro"), 0755)
+		os.Chmod(filepath.Join(dst, "ro"), 0755)
+	})
+	if err := copyPath(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]os.FileMode{
+		"run.sh":  0755,
+		"ro":      0555,
+		"ro/data": 0444,
+	} {
+		info, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s: mode %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"grep 'Hello World' hello.txt", []string{"grep", "Hello World", "hello.txt"}},
+		{"echo 'it''s' ''", []string{"echo", "it's", ""}},
+		{"echo a'b c'd", []string{"echo", "ab cd"}},
+		{"echo $GREETING", []string{"echo", "hello world"}},
+		{"echo x$GREETING.y", []string{"echo", "xhello world.y"}},
+		{"echo '$GREETING'", []string{"echo", "$GREETING"}},
+		{"echo ${PATTERN@R} $PATTERN", []string{"echo", `a\.b\*`, "a.b*"}},
+		{"echo a # comment", []string{"echo", "a"}},
+		{"echo a#b '#c'", []string{"echo", "a#b", "#c"}},
+		{"  echo\ta  ", []string{"echo", "a"}},
+	}
+	ts := &TestScript{
+		t: t,
+		env: environ{
+			"GREETING=hello world",
+			"PATTERN=a.b*",
+		},
+	}
+	for _, tt := range tests {
+		got := ts.parse(tt.line)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parse(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseUnterminatedQuote(t *testing.T) {
+	rt := runScript(t, Params{}, "# comment\nexists 'foo\n")
+	if want := "script:2: unterminated quoted argument"; rt.fatal != want {
+		t.Errorf("failure %q, want %q", rt.fatal, want)
+	}
+}
+
+func TestMkAbsFollowsCD(t *testing.T) {
+	var abs, data string
+	rt := runScript(t, Params{
+		Commands: map[string]func(*TestScript, bool, []string){
+			"check": func(ts *TestScript, neg bool, args []string) {
+				abs = ts.MkAbs("file.txt")
+				data = ts.ReadFile("file.txt")
+				if want := filepath.Join(ts.Getenv("WORK"), "sub", "file.txt"); abs != want {
+					ts.Fatalf("MkAbs = %q, want %q", abs, want)
+				}
+			},
+		},
+	}, "cd sub\ncheck\n-- sub/file.txt --\nnested\n")
+	if rt.failed {
+		t.Fatalf("script failed: %s", rt.fatal)
+	}
+	if data != "nested\n" {
+		t.Errorf("ReadFile = %q, want %q", data, "nested\n")
+	}
+}
+
+// subtestRecorder is a SubtestRunner that records the subtests it runs.
+type subtestRecorder struct {
+	recordingT
+	stop bool
+	ran  []string
+}
+
+func (t *subtestRecorder) Run(name string, f func(TestingT)) bool {
+	t.ran = append(t.ran, name)
+	sub := &recordingT{}
+	f(sub)
+	if sub.failed {
+		t.failed = true
+	}
+	return !sub.failed
+}
+
+func (t *subtestRecorder) StopOnFailure() bool { return t.stop }
+
+func TestFailureStopsRun(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"a", "b"} {
+		file := filepath.Join(dir, name+".tsar")
+		if err := os.WriteFile(file, []byte("exists missing\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	for _, tt := range []struct {
+		stop, continueOnError bool
+		want                  string
+	}{
+		{false, false, "a b"},
+		{true, false, "a"},
+		{true, true, "a b"},
+	} {
+		rt := &subtestRecorder{stop: tt.stop}
+		RunFiles(rt, Params{ContinueOnError: tt.continueOnError}, files...)
+		if got := strings.Join(rt.ran, " "); got != tt.want {
+			t.Errorf("StopOnFailure %v, ContinueOnError %v: ran %q, want %q", tt.stop, tt.continueOnError, got, tt.want)
+		}
+	}
+
+	// Subtests of the testing package are independent: they all run.
+	if _, stop := subtestRunner(t); stop {
+		t.Errorf("a failing subtest of *testing.T stops the run")
+	}
+}
+
+func TestWorkdirNames(t *testing.T) {
+	root := t.TempDir()
+	var files []string
+	for _, dir := range []string{"a", "b"} {
+		file := filepath.Join(t.TempDir(), dir, "same.tsar")
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("exists $WORK\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	rt := &recordingT{}
+	RunFiles(rt, Params{WorkdirRoot: root}, files...)
+	if rt.failed {
+		t.Fatalf("scripts failed: %s", rt.fatal)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d work directories, want 2", len(entries))
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "tsar-same-") {
+			t.Errorf("work directory %q does not include the script name", e.Name())
+		}
+	}
+
+	// With StableWorkdir, the directory is named after the script, and
+	// scripts with the same name are rejected.
+	stable := t.TempDir()
+	rt = &recordingT{}
+	RunFiles(rt, Params{WorkdirRoot: stable, StableWorkdir: true}, files[0])
+	if rt.failed {
+		t.Fatalf("script failed: %s", rt.fatal)
+	}
+	if _, err := os.Stat(filepath.Join(stable, "same")); err != nil {
+		t.Errorf("stable work directory: %v", err)
+	}
+	rt = &recordingT{}
+	RunFiles(rt, Params{WorkdirRoot: stable, StableWorkdir: true}, files...)
+	if want := `duplicate test name "same"`; rt.fatal != want {
+		t.Errorf("failure %q, want %q", rt.fatal, want)
+	}
+
+	// Without WorkdirRoot, StableWorkdir would replace directories of
+	// $TMPDIR, so it is rejected.
+	rt = &recordingT{}
+	RunFiles(rt, Params{StableWorkdir: true}, files[0])
+	if want := "StableWorkdir requires WorkdirRoot"; rt.fatal != want {
+		t.Errorf("failure %q, want %q", rt.fatal, want)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	Run(t, Params{
+		Dir:      "testdata",
+		Parallel: true,
+	})
+}
+
+func BenchmarkRun(b *testing.B) {
+	for range b.N {
+		Run(b, Params{
+			Dir: "examples/testdata",
+		})
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	block := func(ts *TestScript, neg bool, args []string) {
+		<-ts.Context().Done()
+	}
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"Exec", "exists quit.sh\nexec sh quit.sh", `script:2: timed out after`},
+		{"Background", "exec sleep 10 &\nwait", `script:2: timed out after`},
+		{"Command", "block", `script:1: timed out after`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			rt := runScript(t, Params{
+				ScriptTimeout: 500 * time.Millisecond,
+				Commands: map[string]func(*TestScript, bool, []string){
+					"block": block,
+				},
+			}, tt.script+"\n-- quit.sh --\ntrap 'echo got SIGQUIT; exit 3' QUIT\nsleep 10 &\nwait\n")
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("script took %v to time out", elapsed)
+			}
+			if !strings.Contains(rt.fatal, tt.want) {
+				t.Errorf("failure %q does not contain %q", rt.fatal, tt.want)
+			}
+			if tt.name == "Exec" && !strings.Contains(rt.logs.String(), "got SIGQUIT") {
+				t.Errorf("program was not sent SIGQUIT; log:\n%s", rt.logs.String())
+			}
+		})
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	rt := runScript(t, Params{Deadline: time.Now().Add(-time.Second)}, "exists $WORK\n")
+	if want := `script:1: timed out after`; !strings.Contains(rt.fatal, want) {
+		t.Errorf("failure %q does not contain %q", rt.fatal, want)
+	}
+}
+
+func TestScriptFilter(t *testing.T) {
+	dir := t.TempDir()
+	scripts := map[string]string{
+		"fast":       "# tags: unit\nexists $WORK\n",
+		"slow":       "# tags: slow network\nexists $WORK\n",
+		"db_slow":    "# tags: slow db\nexists $WORK\n",
+		"untagged":   "exists $WORK\n",
+		"db_fast":    "# tags: db\nexists $WORK\n",
+		"late_tags":  "exists $WORK\n# tags: unit\n",
+		"also_fast":  "# Comment first.\n\n# tags: unit\nexists $WORK\n",
+		"skip_me_db": "# tags: db\nexists $WORK\n",
+	}
+	var files []string
+	for name, script := range scripts {
+		file := filepath.Join(dir, name+".tsar")
+		if err := os.WriteFile(file, []byte(script), 0666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	slices.Sort(files)
+
+	tests := []struct {
+		name string
+		p    Params
+		want []string
+	}{
+		{"All", Params{}, []string{"also_fast", "db_fast", "db_slow", "fast", "late_tags", "skip_me_db", "slow", "untagged"}},
+		{"Run", Params{RunPattern: "^db_"}, []string{"db_fast", "db_slow"}},
+		{"Skip", Params{RunPattern: "db", SkipPattern: "skip"}, []string{"db_fast", "db_slow"}},
+		{"Tags", Params{Tags: []string{"unit", "network"}}, []string{"also_fast", "fast", "slow"}},
+		{"ExcludeTags", Params{Tags: []string{"!slow", "!unit"}}, []string{"db_fast", "late_tags", "skip_me_db", "untagged"}},
+		{"Mixed", Params{Tags: []string{"db", "!slow"}, SkipPattern: "skip"}, []string{"db_fast"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &recordingT{}
+			RunFiles(rt, tt.p, files...)
+			if rt.failed {
+				t.Fatalf("run failed: %s", rt.fatal)
+			}
+			var ran []string
+			for _, line := range strings.Split(rt.logs.String(), "\n") {
+				if name, ok := strings.CutPrefix(line, "=== RUN   "); ok {
+					ran = append(ran, name)
+				}
+			}
+			if !slices.Equal(ran, tt.want) {
+				t.Errorf("ran %q, want %q", ran, tt.want)
+			}
+		})
+	}
+
+	rt := &recordingT{}
+	RunFiles(rt, Params{RunPattern: "("}, files...)
+	if want := "invalid RunPattern"; !strings.Contains(rt.fatal, want) {
+		t.Errorf("failure %q does not contain %q", rt.fatal, want)
+	}
+}
+
+func TestRecursive(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"top.tsar", "cli/basic.tsar", "cli/flags/short.tsar", ".hidden/skipped.tsar", "cli/notes.txt"} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("exists $WORK\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, recursive := range []bool{false, true} {
+		rt := &recordingT{}
+		Run(rt, Params{Dir: dir, Recursive: recursive})
+		if rt.failed {
+			t.Fatalf("run failed: %s", rt.fatal)
+		}
+		var ran []string
+		for _, line := range strings.Split(rt.logs.String(), "\n") {
+			if name, ok := strings.CutPrefix(line, "=== RUN   "); ok {
+				ran = append(ran, name)
+			}
+		}
+		want := []string{"top"}
+		if recursive {
+			want = []string{"cli/basic", "cli/flags/short", "top"}
+		}
+		if !slices.Equal(ran, want) {
+			t.Errorf("Recursive=%v: ran %q, want %q", recursive, ran, want)
+		}
+	}
+}
+
+func TestUpdateScripts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires echo")
+	}
+	script := `# Golden files are updated in place.
+-- inline.txt --
+old
+-- end --
+exec echo inline
+cmp stdout inline.txt
+
+exec echo hello
+cmp stdout want.txt
+exists missing.txt
+-- want.txt --
+goodbye
+`
+	file := filepath.Join(t.TempDir(), "update.tsar")
+	if err := os.WriteFile(file, []byte(script), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without UpdateScripts, the mismatch fails the script.
+	rt := &recordingT{}
+	RunFiles(rt, Params{}, file)
+	if want := "stdout and inline.txt differ"; !strings.Contains(rt.fatal, want) {
+		t.Fatalf("failure %q does not contain %q", rt.fatal, want)
+	}
+
+	// With it, the sections compared against stdout are rewritten, even
+	// though the script fails later on.
+	rt = &recordingT{}
+	RunFiles(rt, Params{UpdateScripts: true}, file)
+	if want := "missing.txt does not exist"; !strings.Contains(rt.fatal, want) {
+		t.Fatalf("failure %q does not contain %q", rt.fatal, want)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.NewReplacer("old\n", "inline\n", "-- want.txt --\ngoodbye", "-- want.txt --\nhello").Replace(script)
+	if string(data) != want {
+		t.Errorf("updated script:\n%s\nwant:\n%s", data, want)
+	}
+
+	// Files changed by the script no longer stand for their section.
+	rt = runScript(t, Params{UpdateScripts: true}, "exec echo hello\ncp stdout want.txt\nexec echo bye\ncmp stdout want.txt\n-- want.txt --\nold\n")
+	if want := "stdout and want.txt differ"; !strings.Contains(rt.fatal, want) {
+		t.Errorf("failure %q does not contain %q", rt.fatal, want)
+	}
+}
+
+func TestCmpFailure(t *testing.T) {
+	rt := runScript(t, Params{}, "env V=two\ncmpenv got.txt want.txt\n-- got.txt --\none\n2\nthree\n-- want.txt --\none\n$V\nthree\n")
+	want := `script:2: got.txt and want.txt differ:
+--- got.txt
++++ want.txt
+@@ -1,3 +1,3 @@
+ one
+-2
++two
+ three`
+	if rt.fatal != want {
+		t.Errorf("failure:\n%s\nwant:\n%s", rt.fatal, want)
+	}
+
+	// Long diffs are truncated like long output.
+	var long1, long2 strings.Builder
+	for i := range 100 {
+		fmt.Fprintf(&long1, "%d\n", i)
+		fmt.Fprintf(&long2, "%d\n", -i)
+	}
+	rt = runScript(t, Params{}, "cmp a.txt b.txt\n-- a.txt --\n"+long1.String()+"-- b.txt --\n"+long2.String())
+	if !strings.Contains(rt.fatal, "lines omitted ...]") || strings.Count(rt.fatal, "\n") > maxOutputLines+2 {
+		t.Errorf("diff not truncated:\n%s", rt.fatal)
+	}
+
+	rt = runScript(t, Params{}, "cmp -trim a.txt\n-- a.txt --\n")
+	if want := "script:1: usage: cmp [-trim] file1 file2"; rt.fatal != want {
+		t.Errorf("failure %q, want %q", rt.fatal, want)
+	}
+}
+
+func TestStrictArchive(t *testing.T) {
+	script := "mkdir dir\n-- a.txt --\nhello\n! exists b.txt\n"
+	rt := runScript(t, Params{StrictArchive: true}, script)
+	want := `script:4: "! exists b.txt" looks like a command but is part of the trailing archive; close the file section above it with "-- end --" to run it`
+	if rt.fatal != want {
+		t.Errorf("failure %q, want %q", rt.fatal, want)
+	}
+
+	// By default, the trailing archive may hold anything, such as a
+	// commented shell script.
+	script = "exists setup.sh\n-- setup.sh --\n# prepare the output directory\nmkdir out\ncp a out/\n"
+	if rt := runScript(t, Params{}, script); rt.failed {
+		t.Errorf("script with a shell script in its archive failed: %s", rt.fatal)
+	}
+}
+
+func TestCoverDir(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a program")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	src := t.TempDir()
+	for name, data := range map[string]string{
+		"go.mod":  "module prog\n",
+		"main.go": "package main\n\nfunc main() { println(\"covered\") }\n",
+	} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prog := filepath.Join(t.TempDir(), "prog")
+	if runtime.GOOS == "windows" {
+		prog += ".exe"
+	}
+	build := exec.Command(goTool, "build", "-cover", "-o", prog, ".")
+	build.Dir = src
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build -cover: %v\n%s", err, out)
+	}
+
+	coverDir := t.TempDir()
+	p := Params{
+		CoverDir: coverDir,
+		Setup: func(e *Env) error {
+			e.Setenv("PROG", prog)
+			return nil
+		},
+	}
+	rt := runScript(t, p, "exec $PROG\nstderr covered\n")
+	if rt.failed {
+		t.Fatalf("script failed: %s\n%s", rt.fatal, rt.logs.String())
+	}
+	for _, pattern := range []string{"covmeta.*", "covcounters.*"} {
+		files, _ := filepath.Glob(filepath.Join(coverDir, "script", pattern))
+		if len(files) == 0 {
+			t.Errorf("no %s file in %s", pattern, filepath.Join(coverDir, "script"))
+		}
+	}
+}
+
+func TestMergeCoverage(t *testing.T) {
+	// Pretend that the test binary collects coverage into dst, which
+	// already holds the metadata file of an earlier script.
+	dst := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dst, "covmeta.1"), []byte("earlier"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer func(f func() string) { testCoverDir = f }(testCoverDir)
+	testCoverDir = func() string { return dst }
+
+	var scriptDir string
+	p := Params{
+		Commands: map[string]func(*TestScript, bool, []string){
+			// cover writes what a program built with -cover would.
+			"cover": func(ts *TestScript, neg bool, args []string) {
+				scriptDir = ts.Getenv("GOCOVERDIR")
+				for _, name := range []string{"covmeta.1", "covcounters.1.2.3"} {
+					if err := os.WriteFile(filepath.Join(scriptDir, name), []byte("new"), 0666); err != nil {
+						ts.Fatalf("%v", err)
+					}
+				}
+			},
+		},
+	}
+	rt := runScript(t, p, "cover\n")
+	if rt.failed {
+		t.Fatalf("script failed: %s\n%s", rt.fatal, rt.logs.String())
+	}
+	if scriptDir == "" || strings.HasPrefix(scriptDir, dst) {
+		t.Fatalf("script's GOCOVERDIR is %q, want a temporary directory", scriptDir)
+	}
+	for name, want := range map[string]string{"covmeta.1": "earlier", "covcounters.1.2.3": "new"} {
+		data, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s holds %q, %v; want %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Stat(scriptDir); !os.IsNotExist(err) {
+		t.Errorf("temporary coverage directory not removed: %v", err)
+	}
+}
+
+func TestLookPathExt(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("PATHEXT applies to Windows only")
+	}
+	// The programs registered with Main are installed as tsar-echo.exe.
+	rt := runScript(t, Params{}, "exec tsar-echo$exe hi\nexec tsar-echo.EXE hi\n[exec:tsar-echo.exe] exec tsar-echo hi\n")
+	if rt.failed {
+		t.Fatalf("script failed: %s\n%s", rt.fatal, rt.logs.String())
+	}
+}
+
+func TestBuiltinUsage(t *testing.T) {
+	// recordingT.Fatalf returns, so the builtins must stop by themselves
+	// after reporting a usage error.
+	for name := range builtinCmds {
+		if name == "skip" || name == "stop" || name == "wait" || name == "env" {
+			continue // valid without arguments
+		}
+		rt := runScript(t, Params{}, name+"\n")
+		if !strings.Contains(rt.fatal, "script:1: usage: ") {
+			t.Errorf("%s without arguments: failure %q, want a usage error", name, rt.fatal)
+		}
+	}
+
+	// Neither do the scripts go on after skip.
+	if rt := runScript(t, Params{}, "skip\nexists missing\n"); rt.failed {
+		t.Errorf("script went on after skip: %s", rt.fatal)
+	}
+}
+
+// goexitT is a recordingT whose Fatal and Fatalf stop the calling
+// goroutine, as those of *testing.T do.
+type goexitT struct {
+	recordingT
+}
+
+func (t *goexitT) Fatal(args ...any) {
+	t.recordingT.Fatal(args...)
+	runtime.Goexit()
+}
+
+func (t *goexitT) Fatalf(format string, args ...any) {
+	t.recordingT.Fatalf(format, args...)
+	runtime.Goexit()
+}
+
+func TestMergeCoverageAfterFailure(t *testing.T) {
+	dst := t.TempDir()
+	defer func(f func() string) { testCoverDir = f }(testCoverDir)
+	testCoverDir = func() string { return dst }
+
+	var scriptDir string
+	p := Params{
+		Commands: map[string]func(*TestScript, bool, []string){
+			"cover": func(ts *TestScript, neg bool, args []string) {
+				scriptDir = ts.Getenv("GOCOVERDIR")
+				if err := os.WriteFile(filepath.Join(scriptDir, "covcounters.1.2.3"), nil, 0666); err != nil {
+					ts.Fatalf("%v", err)
+				}
+			},
+			"pause": func(ts *TestScript, neg bool, args []string) {
+				time.Sleep(500 * time.Millisecond)
+			},
+		},
+	}
+	// The background command fails once the script has ended, when the
+	// script is already being cleaned up.
+	file := filepath.Join(t.TempDir(), "script.tsar")
+	if err := os.WriteFile(file, []byte("cover\nexec tsar-exit 1 &\npause\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	gt := &goexitT{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		RunFiles(gt, p, file)
+	}()
+	<-done
+	if !strings.Contains(gt.fatal, "background command") {
+		t.Fatalf("failure %q, want a failed background command", gt.fatal)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "covcounters.1.2.3")); err != nil {
+		t.Errorf("coverage data not merged: %v", err)
+	}
+	if _, err := os.Stat(scriptDir); !os.IsNotExist(err) {
+		t.Errorf("temporary coverage directory not removed: %v", err)
+	}
+}
+
+func TestSetStdin(t *testing.T) {
+	p := Params{
+		Commands: map[string]func(*TestScript, bool, []string){
+			"feed": func(ts *TestScript, neg bool, args []string) {
+				ts.SetStdin(strings.NewReader("from Go\n"))
+			},
+		},
+	}
+	rt := runScript(t, p, "feed\nexec tsar-cat\nstdout '^from Go$'\n")
+	if rt.failed {
+		t.Fatalf("script failed: %s\n%s", rt.fatal, rt.logs.String())
+	}
+
+	// The input is used up by the next command even if it can't start.
+	p.Commands["try"] = func(ts *TestScript, neg bool, args []string) {
+		if err := ts.Exec("tsar-no-such-program"); err == nil {
+			ts.Fatalf("missing program ran")
+		}
+	}
+	rt = runScript(t, p, "stdin -s hello\ntry\nexec tsar-cat\n! stdout .\n")
+	if rt.failed {
+		t.Fatalf("script failed: %s\n%s", rt.fatal, rt.logs.String())
+	}
+}
+
+func TestEnv(t *testing.T) {
+	var seen []string
+	p := Params{
+		Setup: func(e *Env) error {
+			e.Setenv("A", "1")
+			e.Setenv("A", "2")
+			e.Values = append(e.Values, "B=1", "B=2")
+			e.Setenv("C", "1")
+			e.Unsetenv("C")
+			return nil
+		},
+		Commands: map[string]func(*TestScript, bool, []string){
+			"environ": func(ts *TestScript, neg bool, args []string) {
+				cmd, err := ts.buildExecCmd(ts.Context(), "tsar-echo")
+				if err != nil {
+					ts.Fatalf("%v", err)
+				}
+				seen = cmd.Env
+			},
+		},
+	}
+	rt := runScript(t, p, `env A B C
+cmp stdout want.txt
+env A=3 -u B D=x=y
+env A B D
+stdout '^3\n\nx=y\n$'
+env PWD=elsewhere
+environ
+-- want.txt --
+2
+2
+
+`)
+	if rt.failed {
+		t.Fatalf("script failed: %s\n%s", rt.fatal, rt.logs.String())
+	}
+	counts := make(map[string]int)
+	for _, kv := range seen {
+		key, _, _ := strings.Cut(kv, "=")
+		counts[key]++
+	}
+	for key, n := range counts {
+		if n != 1 {
+			t.Errorf("exec sees %d values for %s in %q", n, key, seen)
+		}
+	}
+	if !slices.Contains(seen, "A=3") || !slices.Contains(seen, "D=x=y") || counts["B"] != 0 || counts["PWD"] != 1 {
+		t.Errorf("unexpected exec environment %q", seen)
+	}
+}
+
+func TestPassEnv(t *testing.T) {
+	t.Setenv("TSAR_TEST_HOST", "host")
+	script := "env X=$TSAR_TEST_HOST\nenv X\nstdout '^%s$'\n"
+
+	if rt := runScript(t, Params{}, fmt.Sprintf(script, "")); rt.failed {
+		t.Errorf("host variable leaked into the script: %s", rt.fatal)
+	}
+	if rt := runScript(t, Params{PassEnv: []string{"TSAR_TEST_HOST", "TSAR_TEST_UNSET"}}, fmt.Sprintf(script, "host")); rt.failed {
+		t.Errorf("PassEnv variable not passed: %s", rt.fatal)
+	}
+
+	// The variables the system needs to run programs are always passed.
+	for _, key := range systemEnvNames() {
+		if value, ok := os.LookupEnv(key); ok {
+			rt := runScript(t, Params{}, fmt.Sprintf("env %s\nstdout '^%s$'\n", key, regexp.QuoteMeta(value)))
+			if rt.failed {
+				t.Errorf("%s not passed: %s", key, rt.fatal)
+			}
+		}
+	}
+
+	rt := runScript(t, Params{StrictEnv: true}, "env A=1\nexists $A${TSAR_TEST_HOST}\n")
+	if want := "script:2: environment variable TSAR_TEST_HOST is not set"; rt.fatal != want {
+		t.Errorf("failure %q, want %q", rt.fatal, want)
+	}
+}